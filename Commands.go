@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/Sense-Scape/Go_TCP_Websocket_Adapter/v2/Routines"
+)
+
+/*
+Commands the application may be started with. Without a command it
+serves sensor nodes
+*/
+const (
+	serveCommand    = "serve"
+	replayCommand   = "replay"
+	simulateCommand = "simulate"
+)
+
+/*
+CommandOptions holds the options of whichever command was given
+*/
+type CommandOptions struct {
+	Command          string
+	ReplayOptions    Routines.ReplayOptions
+	SimulatorOptions Routines.SimulatorOptions
+}
+
+/*
+Read the command and its options from the command line arguments.
+Options not given take their defaults from the configuration
+*/
+func parseCommand(arguments []string, serverConfig Routines.Config) (CommandOptions, error) {
+	var commandOptions CommandOptions
+
+	if len(arguments) == 0 {
+		commandOptions.Command = serveCommand
+		return commandOptions, nil
+	}
+	commandOptions.Command = arguments[0]
+
+	switch arguments[0] {
+	case serveCommand:
+		return commandOptions, nil
+
+	case replayCommand:
+		replayOptions := &commandOptions.ReplayOptions
+
+		// Replay a recording in place of the TCP and UDP receivers
+		flagSet := flag.NewFlagSet(replayCommand, flag.ContinueOnError)
+		flagSet.StringVar(&replayOptions.FilePath, "file", "", "Recording to replay, gzipped if it ends in .gz")
+		flagSet.Float64Var(&replayOptions.Speed, "speed", 1, "Multiplier applied to the recorded timing")
+		flagSet.BoolVar(&replayOptions.Loop, "loop", false, "Start again from the seek offset once the recording ends")
+		flagSet.DurationVar(&replayOptions.SeekOffset, "seek", 0, "Skip chunks that arrived within this long of the first, such as 90s")
+		if err := flagSet.Parse(arguments[1:]); err != nil {
+			return commandOptions, err
+		}
+
+		// The recording may also be given without -file
+		if replayOptions.FilePath == "" && flagSet.NArg() == 1 {
+			replayOptions.FilePath = flagSet.Arg(0)
+		} else if flagSet.NArg() > 0 {
+			return commandOptions, fmt.Errorf("unexpected arguments %v", flagSet.Args())
+		}
+
+		if replayOptions.FilePath == "" {
+			return commandOptions, errors.New("replay needs a recording, given with -file")
+		}
+		if replayOptions.Speed <= 0 {
+			return commandOptions, errors.New("replay -speed must be greater than 0")
+		}
+		if replayOptions.SeekOffset < 0 {
+			return commandOptions, errors.New("replay -seek must not be negative")
+		}
+		return commandOptions, nil
+
+	case simulateCommand:
+		// Act as sensor nodes sending to the TCP receiver
+		simulatorOptions := &commandOptions.SimulatorOptions
+		var sourceIdentifier, toneFrequencies string
+		var timeChunkTypeIdentifier, fftChunkTypeIdentifier uint
+		var useTLS bool
+		var tlsCAFile, tlsCertificateFile, tlsKeyFile string
+		flagSet := flag.NewFlagSet(simulateCommand, flag.ContinueOnError)
+		flagSet.StringVar(&simulatorOptions.Address, "address", "localhost:"+serverConfig.TCPRxConfig.Port.String(), "Host and port of the TCP receiver")
+		flagSet.IntVar(&simulatorOptions.Producers, "producers", 1, "Sensor nodes simulated, each on its own connection")
+		flagSet.StringVar(&sourceIdentifier, "source", "02:00:00:00:00:01", "Source identifier of the first node, later nodes count up from it")
+		flagSet.IntVar(&simulatorOptions.SampleRate, "sample-rate", 44100, "Samples per second of each channel")
+		flagSet.IntVar(&simulatorOptions.Channels, "channels", 2, "Channels in each TimeChunk")
+		flagSet.IntVar(&simulatorOptions.ChunkSize, "chunk-size", 512, "Samples per channel in each chunk, a power of 2")
+		flagSet.StringVar(&toneFrequencies, "tones", "440,1000", "Comma separated frequencies in Hz of the tones on every channel")
+		flagSet.Float64Var(&simulatorOptions.ToneAmplitude, "amplitude", 0.3, "Amplitude of each tone as a fraction of full scale")
+		flagSet.Float64Var(&simulatorOptions.NoiseAmplitude, "noise", 0.01, "Standard deviation of the noise as a fraction of full scale")
+		flagSet.BoolVar(&simulatorOptions.SendFFTMagnitudeChunks, "fft", true, "Also send the FFT magnitude of every TimeChunk")
+		flagSet.UintVar(&timeChunkTypeIdentifier, "time-chunk-type", uint(chunkTypeIdentifier(serverConfig, "TimeChunk", 1)), "Session header chunk type of TimeChunks")
+		flagSet.UintVar(&fftChunkTypeIdentifier, "fft-chunk-type", uint(chunkTypeIdentifier(serverConfig, "FFTMagnitudeChunk", 7)), "Session header chunk type of FFTMagnitudeChunks")
+		flagSet.IntVar(&simulatorOptions.MaxFrameSize, "max-frame-size", int(serverConfig.TCPRxConfig.MaxFrameSizeBytes), "Largest frame sent, including the frame headers")
+		flagSet.Float64Var(&simulatorOptions.Speed, "speed", 1, "Multiplier on the real time chunk rate, 0 to send as fast as possible")
+		flagSet.IntVar(&simulatorOptions.ChunkCount, "chunks", 0, "Chunks sent by each node before stopping, 0 for no limit")
+		flagSet.Float64Var(&simulatorOptions.DropRate, "drop-rate", 0, "Probability of leaving out each transmission")
+		flagSet.Float64Var(&simulatorOptions.CorruptLengthRate, "corrupt-rate", 0, "Probability of corrupting the length of each frame")
+		flagSet.BoolVar(&useTLS, "tls", false, "Connect over TLS, implied by the other TLS flags")
+		flagSet.StringVar(&tlsCAFile, "tls-ca", "", "PEM CA certificates the receiver's certificate is verified against, the system pool if unset")
+		flagSet.StringVar(&tlsCertificateFile, "tls-cert", "", "PEM client certificate presented to the receiver")
+		flagSet.StringVar(&tlsKeyFile, "tls-key", "", "PEM private key of the client certificate")
+		if err := flagSet.Parse(arguments[1:]); err != nil {
+			return commandOptions, err
+		}
+		if flagSet.NArg() > 0 {
+			return commandOptions, fmt.Errorf("unexpected arguments %v", flagSet.Args())
+		}
+
+		var err error
+		if simulatorOptions.SourceIdentifier, err = Routines.ParseSourceIdentifier(sourceIdentifier); err != nil {
+			return commandOptions, fmt.Errorf("simulate -source: %w", err)
+		}
+		if simulatorOptions.ToneFrequencies, err = Routines.ParseToneFrequencies(toneFrequencies); err != nil {
+			return commandOptions, fmt.Errorf("simulate -tones: %w", err)
+		}
+		simulatorOptions.TimeChunkTypeIdentifier = uint32(timeChunkTypeIdentifier)
+		simulatorOptions.FFTChunkTypeIdentifier = uint32(fftChunkTypeIdentifier)
+		if useTLS || tlsCAFile != "" || tlsCertificateFile != "" || tlsKeyFile != "" {
+			if simulatorOptions.TLSConfig, err = Routines.NewClientTLSConfig(tlsCAFile, tlsCertificateFile, tlsKeyFile); err != nil {
+				return commandOptions, fmt.Errorf("simulate TLS: %w", err)
+			}
+		}
+
+		if simulatorOptions.Producers < 1 {
+			return commandOptions, errors.New("simulate -producers must be at least 1")
+		}
+		if simulatorOptions.SampleRate < 1 || simulatorOptions.Channels < 1 {
+			return commandOptions, errors.New("simulate -sample-rate and -channels must be at least 1")
+		}
+		if simulatorOptions.Speed < 0 || simulatorOptions.ChunkCount < 0 {
+			return commandOptions, errors.New("simulate -speed and -chunks must not be negative")
+		}
+		if simulatorOptions.DropRate < 0 || simulatorOptions.DropRate > 1 || simulatorOptions.CorruptLengthRate < 0 || simulatorOptions.CorruptLengthRate > 1 {
+			return commandOptions, errors.New("simulate -drop-rate and -corrupt-rate must be between 0 and 1")
+		}
+		return commandOptions, nil
+
+	default:
+		return commandOptions, fmt.Errorf("unknown command %q, expected %s, %s or %s", arguments[0], serveCommand, replayCommand, simulateCommand)
+	}
+}
+
+/*
+Identifier of a chunk type from the configuration, or the fallback if
+it is not configured
+*/
+func chunkTypeIdentifier(serverConfig Routines.Config, chunkType string, fallback uint32) uint32 {
+	if identifier, exists := serverConfig.ApplicationConfig.ChunkTypeIdentifiers[chunkType]; exists {
+		return uint32(identifier)
+	}
+	return fallback
+}
@@ -0,0 +1,53 @@
+package Routines
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+///
+///			ADMINISTRATION
+///
+
+/*
+LoggingLevelRequest is the JSON body of /admin/loglevel
+*/
+type LoggingLevelRequest struct {
+	LoggingLevel string // One of Debug, Info, Warning or Error
+}
+
+/*
+Add the /admin endpoints used to adjust the running application to a
+router or a group of routes sharing its access checks
+*/
+func RegisterAdminPaths(router gin.IRoutes, logger *Logger) {
+
+	// Report the current level
+	router.GET("/admin/loglevel", func(c *gin.Context) {
+		c.JSON(http.StatusOK, LoggingLevelRequest{LoggingLevel: LoggingLevelName(logger.Level())})
+	})
+
+	// And change it without restarting
+	router.PUT("/admin/loglevel", func(c *gin.Context) {
+		var loggingLevelRequest LoggingLevelRequest
+		if err := c.ShouldBindJSON(&loggingLevelRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Expected a JSON body such as {\"LoggingLevel\": \"Debug\"}"})
+			return
+		}
+
+		logLevel, validLevel := ParseLoggingLevel(loggingLevelRequest.LoggingLevel)
+		if !validLevel {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "LoggingLevel - " + loggingLevelRequest.LoggingLevel + " - is not one of Debug, Info, Warning or Error"})
+			return
+		}
+
+		// Logged at the new level so the change is always recorded
+		previousLevel := logger.Level()
+		logger.SetLevel(logLevel)
+		logger.Log(logLevel, "Logging level changed", "previous_level", LoggingLevelName(previousLevel),
+			"logging_level", LoggingLevelName(logLevel), "remote_address", c.Request.RemoteAddr)
+
+		c.JSON(http.StatusOK, LoggingLevelRequest{LoggingLevel: LoggingLevelName(logLevel)})
+	})
+}
@@ -0,0 +1,251 @@
+package Routines
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+///
+///			WEBSOCKET CLIENT AUTHENTICATION
+///
+
+// Query parameter holding an access token, for clients that cannot set headers
+const accessTokenQueryParameter = "token"
+
+// Entry of AllowedOrigins that allows every origin
+const anyOrigin = "*"
+
+var (
+	ErrOriginNotAllowed      = errors.New("origin is not allowed")
+	ErrAccessTokenMissing    = errors.New("access token is missing")
+	ErrAccessTokenInvalid    = errors.New("access token is not valid")
+	ErrChunkTypeNotPermitted = errors.New("access token does not permit this chunk type")
+	ErrAdminNotPermitted     = errors.New("access token does not permit administration")
+	ErrAdminNotConfigured    = errors.New("no access token permits administration")
+)
+
+/*
+WebSocketAuthenticator decides which WebSocket clients may connect, by
+the origin of browser clients and by the access token each client presents
+*/
+type WebSocketAuthenticator struct {
+	allowAnyOrigin bool            // AllowedOrigins holds "*"
+	allowedOrigins map[string]bool // Lower case origins browsers may connect from
+	accessTokens   []AccessToken   // Tokens clients must present, empty to allow anyone
+	adminTokens    bool            // Whether any access token is marked Admin
+	publicMetrics  bool            // Serve /metrics to anyone while no Admin token is configured
+}
+
+func NewWebSocketAuthenticator(webSocketTxConfig WebSocketTxConfig) *WebSocketAuthenticator {
+	authenticator := new(WebSocketAuthenticator)
+	authenticator.allowedOrigins = make(map[string]bool)
+	for _, origin := range webSocketTxConfig.AllowedOrigins {
+		if origin == anyOrigin {
+			authenticator.allowAnyOrigin = true
+		}
+		authenticator.allowedOrigins[normaliseOrigin(origin)] = true
+	}
+	authenticator.accessTokens = webSocketTxConfig.AccessTokens
+	for _, accessToken := range webSocketTxConfig.AccessTokens {
+		if accessToken.Admin {
+			authenticator.adminTokens = true
+		}
+	}
+	authenticator.publicMetrics = bool(webSocketTxConfig.PublicMetrics)
+	return authenticator
+}
+
+/*
+CheckOrigin is used as websocket.Upgrader.CheckOrigin. Requests without
+an Origin header come from clients other than browsers and are allowed,
+as are browsers on a page served by the same host
+*/
+func (a *WebSocketAuthenticator) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || a.allowAnyOrigin || a.allowedOrigins[normaliseOrigin(origin)] {
+		return true
+	}
+
+	originURL, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(originURL.Host, r.Host)
+}
+
+/*
+Authenticate checks the origin and access token of a request
+
+returns the access token presented, the zero token permitting every
+chunk type if none are configured
+*/
+func (a *WebSocketAuthenticator) Authenticate(r *http.Request) (AccessToken, error) {
+	if !a.CheckOrigin(r) {
+		return AccessToken{}, ErrOriginNotAllowed
+	}
+	return a.matchAccessToken(r)
+}
+
+/*
+The configured token presented with a request, the zero token if none
+are configured
+*/
+func (a *WebSocketAuthenticator) matchAccessToken(r *http.Request) (AccessToken, error) {
+	if len(a.accessTokens) == 0 {
+		return AccessToken{}, nil
+	}
+
+	presentedToken := requestAccessToken(r)
+	if presentedToken == "" {
+		return AccessToken{}, ErrAccessTokenMissing
+	}
+
+	// Compare against every token in constant time so that
+	// response times do not reveal how much of a token matched
+	var matchedToken *AccessToken
+	for index := range a.accessTokens {
+		if subtle.ConstantTimeCompare([]byte(presentedToken), []byte(a.accessTokens[index].Token)) == 1 {
+			matchedToken = &a.accessTokens[index]
+		}
+	}
+	if matchedToken == nil {
+		return AccessToken{}, ErrAccessTokenInvalid
+	}
+	return *matchedToken, nil
+}
+
+/*
+RequireAdmin is middleware refusing requests without an access token
+marked Admin. Without any Admin token configured every request is
+refused. Origins are not checked as administration is not done from browsers
+*/
+func (a *WebSocketAuthenticator) RequireAdmin(c *gin.Context) {
+	if !a.adminTokens {
+		abortUnauthorised(c, ErrAdminNotConfigured)
+		return
+	}
+
+	accessToken, err := a.matchAccessToken(c.Request)
+	if err == nil && !accessToken.Admin {
+		err = ErrAdminNotPermitted
+	}
+	if err == nil {
+		return
+	}
+	abortUnauthorised(c, err)
+}
+
+/*
+RequireMetricsAccess is middleware protecting /metrics with an Admin
+access token once one is configured. Until then metrics are served to
+anyone when PublicMetrics is set, and to no one otherwise
+*/
+func (a *WebSocketAuthenticator) RequireMetricsAccess(c *gin.Context) {
+	if a.adminTokens {
+		a.RequireAdmin(c)
+	} else if !a.publicMetrics {
+		abortUnauthorised(c, ErrAdminNotConfigured)
+	}
+}
+
+/*
+Whether /metrics is served without an access token
+*/
+func (a *WebSocketAuthenticator) MetricsArePublic() bool {
+	return !a.adminTokens && a.publicMetrics
+}
+
+/*
+Authorise checks that a request may subscribe to a chunk type
+
+returns the name of the access token presented, empty if none is required
+*/
+func (a *WebSocketAuthenticator) Authorise(r *http.Request, chunkType string) (string, error) {
+	accessToken, err := a.Authenticate(r)
+	if err != nil {
+		return "", err
+	}
+	if !accessToken.Permits(chunkType) {
+		return accessToken.Name, ErrChunkTypeNotPermitted
+	}
+	return accessToken.Name, nil
+}
+
+/*
+Permits reports whether the token may subscribe to a chunk type
+*/
+func (t AccessToken) Permits(chunkType string) bool {
+	if len(t.ChunkTypes) == 0 {
+		return true
+	}
+	for _, permittedChunkType := range t.ChunkTypes {
+		if permittedChunkType == chunkType {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+HTTP status and metric reason a request is refused with for an
+authorisation error
+*/
+func authorisationFailure(err error) (int, string) {
+	switch err {
+	case ErrOriginNotAllowed:
+		return http.StatusForbidden, rejectOriginNotAllowed
+	case ErrAccessTokenMissing:
+		return http.StatusUnauthorized, rejectAccessTokenMissing
+	case ErrAccessTokenInvalid:
+		return http.StatusUnauthorized, rejectAccessTokenInvalid
+	default:
+		return http.StatusForbidden, rejectChunkTypeNotPermitted
+	}
+}
+
+/*
+Refuse a request to an administrative path with the status for an
+authorisation error
+*/
+func abortUnauthorised(c *gin.Context, err error) {
+	statusCode, _ := authorisationFailure(err)
+	if statusCode == http.StatusUnauthorized {
+		c.Header("WWW-Authenticate", "Bearer")
+	}
+	c.AbortWithStatusJSON(statusCode, gin.H{"error": err.Error()})
+}
+
+/*
+The bearer token of the Authorization header, or failing that the token
+query parameter
+*/
+func requestAccessToken(r *http.Request) string {
+	authorisation := r.Header.Get("Authorization")
+	if scheme, token, found := strings.Cut(authorisation, " "); found && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return r.URL.Query().Get(accessTokenQueryParameter)
+}
+
+/*
+Middleware that moves an access token in the query into the
+Authorization header, so that it is not written to the request log
+*/
+func hideAccessTokenQuery(c *gin.Context) {
+	query := c.Request.URL.Query()
+	if !query.Has(accessTokenQueryParameter) {
+		return
+	}
+
+	if c.Request.Header.Get("Authorization") == "" {
+		c.Request.Header.Set("Authorization", "Bearer "+query.Get(accessTokenQueryParameter))
+	}
+	query.Del(accessTokenQueryParameter)
+	c.Request.URL.RawQuery = query.Encode()
+}
+
+func normaliseOrigin(origin string) string {
+	return strings.ToLower(strings.TrimSuffix(origin, "/"))
+}
@@ -0,0 +1,86 @@
+package Routines
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+var testAccessTokens = []AccessToken{
+	{Name: "dashboard", Token: "dashboard-token"},
+	{Name: "operator", Token: "operator-token", Admin: true},
+}
+
+/*
+Request a path guarded by the middleware, returning the response status
+*/
+func serveGuardedPath(middleware gin.HandlerFunc, token string) int {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/guarded", middleware, func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/guarded", nil)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response.Code
+}
+
+func TestRequireMetricsAccess(t *testing.T) {
+	testCases := []struct {
+		name          string
+		accessTokens  []AccessToken
+		publicMetrics FlexibleBool
+		token         string
+		wantStatus    int
+	}{
+		{"public without tokens", nil, true, "", http.StatusOK},
+		{"closed without tokens", nil, false, "", http.StatusForbidden},
+		{"public without admin tokens", testAccessTokens[:1], true, "", http.StatusOK},
+		{"admin token required", testAccessTokens, true, "", http.StatusUnauthorized},
+		{"unknown token", testAccessTokens, true, "guess", http.StatusUnauthorized},
+		{"client token", testAccessTokens, true, "dashboard-token", http.StatusForbidden},
+		{"admin token", testAccessTokens, true, "operator-token", http.StatusOK},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			authenticator := NewWebSocketAuthenticator(WebSocketTxConfig{AccessTokens: testCase.accessTokens, PublicMetrics: testCase.publicMetrics})
+			if status := serveGuardedPath(authenticator.RequireMetricsAccess, testCase.token); status != testCase.wantStatus {
+				t.Errorf("status is %d, want %d", status, testCase.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	testCases := []struct {
+		name         string
+		accessTokens []AccessToken
+		token        string
+		wantStatus   int
+	}{
+		{"no tokens", nil, "", http.StatusForbidden},
+		{"no tokens with a token presented", nil, "operator-token", http.StatusForbidden},
+		{"no admin tokens", testAccessTokens[:1], "dashboard-token", http.StatusForbidden},
+		{"admin token required", testAccessTokens, "", http.StatusUnauthorized},
+		{"unknown token", testAccessTokens, "guess", http.StatusUnauthorized},
+		{"client token", testAccessTokens, "dashboard-token", http.StatusForbidden},
+		{"admin token", testAccessTokens, "operator-token", http.StatusOK},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			authenticator := NewWebSocketAuthenticator(WebSocketTxConfig{AccessTokens: testCase.accessTokens, PublicMetrics: true})
+			if status := serveGuardedPath(authenticator.RequireAdmin, testCase.token); status != testCase.wantStatus {
+				t.Errorf("status is %d, want %d", status, testCase.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package Routines
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+///
+///			WEBSOCKET MESSAGE FORMATS
+///
+
+/*
+MessageFormat is how chunks are written to a WebSocket client
+*/
+type MessageFormat string
+
+const (
+	MessageFormatJSON   MessageFormat = "json"   // Text messages holding the chunk JSON
+	MessageFormatBinary MessageFormat = "binary" // Binary messages with numeric arrays packed
+)
+
+// Query parameter clients choose the message format with
+const messageFormatQueryParameter = "format"
+
+// Version written as the first byte of every binary message
+const binaryChunkVersion = 1
+
+// Element types of packed numeric arrays
+const (
+	binaryElementInt16   = 1
+	binaryElementFloat32 = 2
+	binaryElementInt32   = 3
+	binaryElementFloat64 = 4
+)
+
+// Bytes before the metadata of a binary message
+const binaryChunkHeaderSize = 27
+
+/*
+Parse a message format, with an empty string meaning JSON
+*/
+func ParseMessageFormat(format string) (MessageFormat, error) {
+	switch MessageFormat(strings.ToLower(format)) {
+	case "", MessageFormatJSON:
+		return MessageFormatJSON, nil
+	case MessageFormatBinary:
+		return MessageFormatBinary, nil
+	}
+	return "", errors.New("unknown message format " + strconv.Quote(format) + ", expected json or binary")
+}
+
+/*
+Lazily encoded binary message shared by every copy of a chunk, so that
+a chunk is only encoded once however many clients want it
+*/
+type binaryChunkMessage struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+/*
+BinaryMessage returns the chunk encoded by EncodeBinaryChunk
+*/
+func (c Chunk) BinaryMessage() ([]byte, error) {
+	if c.binaryMessage == nil {
+		return EncodeBinaryChunk(c)
+	}
+	c.binaryMessage.once.Do(func() {
+		c.binaryMessage.data, c.binaryMessage.err = EncodeBinaryChunk(c)
+	})
+	return c.binaryMessage.data, c.binaryMessage.err
+}
+
+/*
+EncodeBinaryChunk packs a chunk into the compact binary form described in
+the README. Every array in the JSON holding only numbers is removed from
+the metadata and packed after it. Integers are packed as int16 or int32
+if every value fits, and any other numbers as float32 if every value is
+unchanged by it, or float64 otherwise
+*/
+func EncodeBinaryChunk(chunk Chunk) ([]byte, error) {
+
+	// Numbers are kept as written so that integers can be told apart
+	decoder := json.NewDecoder(strings.NewReader(chunk.JSONData))
+	decoder.UseNumber()
+	var chunkValue interface{}
+	if err := decoder.Decode(&chunkValue); err != nil {
+		return nil, err
+	}
+
+	var packedArrays []packedArray
+	metadata := extractNumericArrays(chunkValue, "", &packedArrays)
+	metadataBytes, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	if len(packedArrays) > math.MaxUint16 {
+		return nil, errors.New("chunk holds too many numeric arrays to pack")
+	}
+
+	// Header
+	message := make([]byte, 0, binaryChunkHeaderSize+len(metadataBytes)+len(chunk.JSONData)/2)
+	message = append(message, binaryChunkVersion)
+	message = binary.LittleEndian.AppendUint32(message, chunk.ChunkTypeIdentifier)
+	message = append(message, chunk.SourceIdentifier[:]...)
+	message = binary.LittleEndian.AppendUint32(message, chunk.SessionNumber)
+	message = binary.LittleEndian.AppendUint64(message, uint64(chunk.ArrivalTime.UnixMicro()))
+
+	// Metadata
+	message = binary.LittleEndian.AppendUint32(message, uint32(len(metadataBytes)))
+	message = append(message, metadataBytes...)
+
+	// Then each packed array
+	message = binary.LittleEndian.AppendUint16(message, uint16(len(packedArrays)))
+	for _, array := range packedArrays {
+		if len(array.path) > math.MaxUint8 {
+			return nil, errors.New("path of numeric array " + strconv.Quote(array.path) + " is longer than 255 bytes")
+		}
+		message = append(message, byte(len(array.path)))
+		message = append(message, array.path...)
+		message = append(message, array.elementType)
+		message = binary.LittleEndian.AppendUint32(message, uint32(len(array.values)))
+		for _, value := range array.values {
+			switch array.elementType {
+			case binaryElementInt16:
+				message = binary.LittleEndian.AppendUint16(message, uint16(int16(value)))
+			case binaryElementInt32:
+				message = binary.LittleEndian.AppendUint32(message, uint32(int32(value)))
+			case binaryElementFloat64:
+				message = binary.LittleEndian.AppendUint64(message, math.Float64bits(value))
+			default:
+				message = binary.LittleEndian.AppendUint32(message, math.Float32bits(float32(value)))
+			}
+		}
+	}
+
+	return message, nil
+}
+
+/*
+Numeric array removed from the metadata, named by its dotted path
+*/
+type packedArray struct {
+	path        string
+	elementType byte
+	values      []float64
+}
+
+/*
+Walk a decoded JSON value, moving numeric arrays into packedArrays in
+path order and returning what remains. Numeric arrays within arrays are
+replaced by null to keep the positions of the other elements
+*/
+func extractNumericArrays(value interface{}, path string, packedArrays *[]packedArray) interface{} {
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(typedValue))
+		for key := range typedValue {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		remaining := make(map[string]interface{}, len(typedValue))
+		for _, key := range keys {
+			if array, isNumeric := packNumericArray(typedValue[key], joinPath(path, key)); isNumeric {
+				*packedArrays = append(*packedArrays, array)
+				continue
+			}
+			remaining[key] = extractNumericArrays(typedValue[key], joinPath(path, key), packedArrays)
+		}
+		return remaining
+
+	case []interface{}:
+		remaining := make([]interface{}, len(typedValue))
+		for index, element := range typedValue {
+			elementPath := joinPath(path, strconv.Itoa(index))
+			if array, isNumeric := packNumericArray(element, elementPath); isNumeric {
+				*packedArrays = append(*packedArrays, array)
+				continue
+			}
+			remaining[index] = extractNumericArrays(element, elementPath, packedArrays)
+		}
+		return remaining
+	}
+	return value
+}
+
+/*
+Convert a non-empty array holding only numbers into a packed array, using
+the smallest type that holds every value exactly, or float64
+*/
+func packNumericArray(value interface{}, path string) (packedArray, bool) {
+	elements, isArray := value.([]interface{})
+	if !isArray || len(elements) == 0 {
+		return packedArray{}, false
+	}
+
+	array := packedArray{path: path, values: make([]float64, len(elements))}
+	allIntegers := true
+	fitsFloat32 := true
+	var minimum, maximum int64
+	for index, element := range elements {
+		number, isNumber := element.(json.Number)
+		if !isNumber {
+			return packedArray{}, false
+		}
+
+		if integer, err := strconv.ParseInt(string(number), 10, 64); err == nil {
+			array.values[index] = float64(integer)
+			if index == 0 || integer < minimum {
+				minimum = integer
+			}
+			if index == 0 || integer > maximum {
+				maximum = integer
+			}
+			continue
+		}
+		floatValue, err := number.Float64()
+		if err != nil {
+			return packedArray{}, false
+		}
+		array.values[index] = floatValue
+		allIntegers = false
+		if !fitsFloat32Exactly(floatValue) {
+			fitsFloat32 = false
+		}
+	}
+
+	switch {
+	case !allIntegers && fitsFloat32:
+		array.elementType = binaryElementFloat32
+	case !allIntegers:
+		array.elementType = binaryElementFloat64
+	case minimum >= math.MinInt16 && maximum <= math.MaxInt16:
+		array.elementType = binaryElementInt16
+	case minimum >= math.MinInt32 && maximum <= math.MaxInt32:
+		array.elementType = binaryElementInt32
+	default:
+		array.elementType = binaryElementFloat64
+	}
+	return array, true
+}
+
+/*
+Whether a number is unchanged by packing it as float32. The shortest
+decimal form of the nearest float32 is compared, so that numbers written
+from float32 values, such as 0.1, fit while doubles and numbers beyond the
+range of float32 do not
+*/
+func fitsFloat32Exactly(value float64) bool {
+	float32Text := strconv.FormatFloat(float64(float32(value)), 'g', -1, 32)
+	roundTripped, err := strconv.ParseFloat(float32Text, 64)
+	return err == nil && roundTripped == value
+}
+
+/*
+Encode a chunk in the given format
+
+returns the WebSocket message type and payload
+*/
+func encodeChunkMessage(chunk Chunk, format MessageFormat) (int, []byte, error) {
+	if format == MessageFormatBinary {
+		message, err := chunk.BinaryMessage()
+		return websocket.BinaryMessage, message, err
+	}
+	return websocket.TextMessage, []byte(chunk.JSONData), nil
+}
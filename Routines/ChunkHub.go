@@ -0,0 +1,229 @@
+package Routines
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+///
+///			ROUTINE SAFE HUB FUNCTIONS
+///
+
+/*
+SlowClientPolicy decides what happens when a subscriber's buffer is full
+*/
+type SlowClientPolicy string
+
+const (
+	SlowClientDropNewest SlowClientPolicy = "DropNewest" // Drop the chunk being published
+	SlowClientDropOldest SlowClientPolicy = "DropOldest" // Drop the oldest buffered chunk to make room
+	SlowClientDisconnect SlowClientPolicy = "Disconnect" // Tell the subscriber it has fallen behind
+)
+
+/*
+Parse a slow client policy, ignoring case
+*/
+func ParseSlowClientPolicy(policy string) (SlowClientPolicy, error) {
+	for _, slowClientPolicy := range []SlowClientPolicy{SlowClientDropNewest, SlowClientDropOldest, SlowClientDisconnect} {
+		if strings.EqualFold(policy, string(slowClientPolicy)) {
+			return slowClientPolicy, nil
+		}
+	}
+	return "", errors.New("unknown slow client policy " + policy + ", expected DropNewest, DropOldest or Disconnect")
+}
+
+/*
+A subscriber receives its own copy of every chunk published on the
+chunk type it subscribed to. Each subscriber has its own buffer so a
+slow client does not hold up any other client
+*/
+type ChunkSubscriber struct {
+	ChunkType      string        // Chunk type this subscriber is listening to
+	Channel        chan Chunk    // Buffered channel of chunks for this subscriber
+	droppedCounter uint64        // Number of chunks dropped because the buffer was full
+	overflowed     chan struct{} // Closed when the buffer fills under the Disconnect policy
+	overflowOnce   sync.Once
+}
+
+/*
+Closed once the subscriber has fallen behind under the Disconnect
+policy, after which it should be unsubscribed
+*/
+func (s *ChunkSubscriber) Overflowed() <-chan struct{} {
+	return s.overflowed
+}
+
+/*
+Number of chunks that could not be delivered to this subscriber
+because its buffer was full
+*/
+func (s *ChunkSubscriber) DroppedCount() uint64 {
+	return atomic.LoadUint64(&s.droppedCounter)
+}
+
+/*
+Routine safe publish/subscribe hub. Each registered chunk type has a
+set of subscribers and every published chunk is copied to all of them
+*/
+type ChunkBroadcastHub struct {
+	mu                     sync.RWMutex                               // Mutex to protect access to the map
+	chunkTypeSubscriberMap map[string](map[*ChunkSubscriber]struct{}) // Map of chunk type string and its subscribers
+	subscriberBufferSize   int                                        // Number of chunks buffered per subscriber
+	slowClientPolicy       SlowClientPolicy                           // What happens when a subscriber's buffer is full
+}
+
+/*
+Create a hub in which each registered chunk type may be subscribed to
+*/
+func NewChunkBroadcastHub(registeredChunkTypes []string, subscriberBufferSize int, slowClientPolicy SlowClientPolicy) *ChunkBroadcastHub {
+
+	chunkTypeSubscriberMap := make(map[string](map[*ChunkSubscriber]struct{}))
+	for _, chunkType := range registeredChunkTypes {
+		chunkTypeSubscriberMap[chunkType] = make(map[*ChunkSubscriber]struct{})
+	}
+
+	hub := new(ChunkBroadcastHub)
+	hub.chunkTypeSubscriberMap = chunkTypeSubscriberMap
+	hub.subscriberBufferSize = subscriberBufferSize
+	hub.slowClientPolicy = slowClientPolicy
+
+	return hub
+}
+
+/*
+Returns whether the chunk type was registered with the hub
+*/
+func (h *ChunkBroadcastHub) IsRegistered(chunkType string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	_, exists := h.chunkTypeSubscriberMap[chunkType]
+	return exists
+}
+
+/*
+The chunk will be copied to every subscriber of its chunk type given
+that the chunk type is registered. A subscriber whose buffer is full
+never blocks the publisher; a chunk is dropped or the subscriber told
+it has fallen behind according to the slow client policy
+*/
+func (h *ChunkBroadcastHub) Publish(chunk Chunk) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	subscribers, exists := h.chunkTypeSubscriberMap[chunk.ChunkType]
+	if !exists {
+		return false
+	}
+
+	for subscriber := range subscribers {
+		select {
+		case subscriber.Channel <- chunk:
+			continue
+		default:
+		}
+
+		switch h.slowClientPolicy {
+		case SlowClientDropOldest:
+			// Make room by dropping the oldest chunk, unless
+			// the subscriber has just made room itself
+			select {
+			case <-subscriber.Channel:
+				subscriber.dropChunk(chunk.ChunkType)
+			default:
+			}
+			select {
+			case subscriber.Channel <- chunk:
+			default:
+				subscriber.dropChunk(chunk.ChunkType)
+			}
+		case SlowClientDisconnect:
+			subscriber.dropChunk(chunk.ChunkType)
+			subscriber.overflowOnce.Do(func() {
+				close(subscriber.overflowed)
+			})
+		default:
+			subscriber.dropChunk(chunk.ChunkType)
+		}
+	}
+
+	return true
+}
+
+func (s *ChunkSubscriber) dropChunk(chunkType string) {
+	atomic.AddUint64(&s.droppedCounter, 1)
+	metricWebSocketMessagesDropped.WithLabelValues(chunkType, messageDropBufferFull).Inc()
+}
+
+/*
+Add a subscriber to a registered chunk type. The subscriber should be
+removed with Unsubscribe once it is no longer read from
+*/
+func (h *ChunkBroadcastHub) Subscribe(chunkType string) (*ChunkSubscriber, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subscribers, exists := h.chunkTypeSubscriberMap[chunkType]
+	if !exists {
+		return nil, false
+	}
+
+	subscriber := new(ChunkSubscriber)
+	subscriber.ChunkType = chunkType
+	subscriber.Channel = make(chan Chunk, h.subscriberBufferSize)
+	subscriber.overflowed = make(chan struct{})
+	subscribers[subscriber] = struct{}{}
+
+	return subscriber, true
+}
+
+/*
+Remove a subscriber so no further chunks are copied to it
+*/
+func (h *ChunkBroadcastHub) Unsubscribe(subscriber *ChunkSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if subscribers, exists := h.chunkTypeSubscriberMap[subscriber.ChunkType]; exists {
+		delete(subscribers, subscriber)
+	}
+}
+
+/*
+Number of subscribers currently attached to a chunk type
+*/
+func (h *ChunkBroadcastHub) SubscriberCount(chunkType string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return len(h.chunkTypeSubscriberMap[chunkType])
+}
+
+/*
+Point in time statistics of a single chunk type
+*/
+type ChunkTypeStatistics struct {
+	ChunkType       string // The registered chunk type
+	SubscriberCount int    // Number of subscribers
+	BufferedChunks  int    // Chunks waiting in subscriber buffers
+}
+
+/*
+Statistics of every registered chunk type
+*/
+func (h *ChunkBroadcastHub) Statistics() []ChunkTypeStatistics {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var statistics []ChunkTypeStatistics
+	for chunkType, subscribers := range h.chunkTypeSubscriberMap {
+		chunkTypeStatistics := ChunkTypeStatistics{ChunkType: chunkType, SubscriberCount: len(subscribers)}
+		for subscriber := range subscribers {
+			chunkTypeStatistics.BufferedChunks += len(subscriber.Channel)
+		}
+		statistics = append(statistics, chunkTypeStatistics)
+	}
+	return statistics
+}
@@ -0,0 +1,608 @@
+package Routines
+
+import (
+	"compress/flate"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+///
+///			CONFIGURATION TYPES
+///
+
+/*
+Config is the typed form of Config.json. Each section is consumed by
+the routine of the same name
+*/
+type Config struct {
+	ApplicationConfig ApplicationConfig
+	LoggingConfig     LoggingConfig
+	TCPRxConfig       TCPRxConfig
+	UDPRxConfig       UDPRxConfig
+	WebSocketTxConfig WebSocketTxConfig
+	RecorderConfig    RecorderConfig
+}
+
+/*
+ApplicationConfig controls behaviour that spans every routine
+*/
+type ApplicationConfig struct {
+	ShutdownTimeoutSeconds FlexibleInt            // Time allowed for routines to stop before exiting anyway
+	ChunkTypeIdentifiers   map[string]FlexibleInt // Chunk type names and their identifiers in the session header
+}
+
+/*
+LoggingConfig controls the level and outputs of the logging routine
+*/
+type LoggingConfig struct {
+	LoggingLevel         string       // One of Debug, Info, Warning or Error
+	LogToFile            FlexibleBool // Write log messages to a file
+	LogToConsole         FlexibleBool // Write log messages to stdout
+	MessageBufferSize    FlexibleInt  // Messages queued before further messages are dropped
+	LogDirectory         string       // Directory log files are written to
+	LogFileName          string       // Log file name, optionally holding {timestamp}
+	MaxFileSizeMB        FlexibleInt  // Rotate the log file before it exceeds this size, 0 for no limit
+	MaxFileAgeHours      FlexibleInt  // Rotate the log file once it is this old, 0 for no limit
+	MaxRetainedFiles     FlexibleInt  // Rotated log files kept, 0 to keep all
+	CompressRotatedFiles FlexibleBool // Gzip log files once they have been rotated
+}
+
+/*
+TCPRxConfig controls the TCP listener that sensor nodes connect to
+*/
+type TCPRxConfig struct {
+	Port                  FlexibleInt // Port the TCP listener binds to
+	MaxConnections        FlexibleInt // Maximum number of producers connected at once
+	MaxFrameSizeBytes     FlexibleInt // Frames longer than this are treated as corrupt
+	SessionTimeoutSeconds FlexibleInt // Partial sessions idle for longer than this are dropped
+	TLSCertificateFile    string      // PEM certificate chain, requiring TLS when set
+	TLSKeyFile            string      // PEM private key of the certificate
+	ClientCAFile          string      // PEM CA certificates that client certificates must be signed by, optional
+}
+
+/*
+UDPRxConfig controls the optional UDP receiver that sensor nodes may stream to
+*/
+type UDPRxConfig struct {
+	Enabled               FlexibleBool // Whether to start the UDP receiver
+	Port                  FlexibleInt  // Port the UDP socket binds to
+	MaxFrameSizeBytes     FlexibleInt  // Frames longer than this are treated as corrupt
+	SessionTimeoutSeconds FlexibleInt  // Partial sessions idle for longer than this are dropped
+	ReorderWindow         FlexibleInt  // How many transmissions may arrive ahead of their turn
+}
+
+/*
+WebSocketTxConfig controls the HTTP router that serves WebSocket clients
+*/
+type WebSocketTxConfig struct {
+	Port                        FlexibleInt            // Port the HTTP router binds to
+	RegisteredChunks            []string               // Chunk types clients may subscribe to
+	TLSCertificateFile          string                 // PEM certificate chain, serving wss:// when set
+	TLSKeyFile                  string                 // PEM private key of the certificate
+	HTTPRedirectPort            FlexibleInt            // Port redirecting plain HTTP to HTTPS, 0 for none
+	AllowedOrigins              []string               // Origins browsers may connect from, "*" for any
+	AccessTokens                []AccessToken          // Tokens clients must present, empty to allow anyone
+	PublicMetrics               FlexibleBool           // Serve /metrics to anyone while no Admin token is configured
+	EnableCompression           FlexibleBool           // Offer permessage-deflate compression to clients
+	CompressionLevel            FlexibleInt            // Flate level from -2 for Huffman only to 9 for best compression
+	CompressionThresholdBytes   FlexibleInt            // Messages smaller than this are sent uncompressed
+	ReadBufferSize              FlexibleInt            // Bytes buffered when reading from each client, 0 for 4096
+	WriteBufferSize             FlexibleInt            // Bytes buffered when writing to each client, 0 for 4096
+	DefaultMaxMessagesPerSecond FlexibleInt            // Messages each client receives per second at most, 0 for no limit
+	MaxMessagesPerSecond        map[string]FlexibleInt // Limits for particular chunk types, overriding the default
+	ClientQueueSize             FlexibleInt            // Chunks queued for each client before it is treated as slow
+	SlowClientPolicy            string                 // One of DropNewest, DropOldest or Disconnect
+	WriteTimeoutSeconds         FlexibleInt            // Clients that take longer than this to accept a message are disconnected
+	KeepaliveTimeoutSeconds     FlexibleInt            // Clients silent for this long, including pongs, are disconnected, 0 to disable
+}
+
+/*
+AccessToken is presented by WebSocket clients as a bearer token or in
+the token query parameter, and by administrators of /metrics and /admin
+*/
+type AccessToken struct {
+	Name       string       // Identifies the client in logs
+	Token      string       // Secret the client presents
+	ChunkTypes []string     // Chunk types the token may subscribe to, empty for all
+	Admin      FlexibleBool // Whether the token may use /metrics and /admin
+}
+
+/*
+RecorderConfig controls the optional recorder that writes every chunk to disk
+*/
+type RecorderConfig struct {
+	Enabled              FlexibleBool // Whether to start the recorder
+	Directory            string       // Directory recordings are written to
+	FileName             string       // Recording file name, optionally holding {timestamp}
+	MaxFileSizeMB        FlexibleInt  // Start a new recording before it exceeds this size, 0 for no limit
+	MaxFileAgeHours      FlexibleInt  // Start a new recording once it is this old, 0 for no limit
+	MaxRetainedFiles     FlexibleInt  // Finished recordings kept, 0 to keep all
+	CompressRotatedFiles FlexibleBool // Gzip recordings once they are finished
+	ChunkBufferSize      FlexibleInt  // Chunks queued before further chunks are dropped
+}
+
+/*
+DefaultConfig returns the configuration used for any section or field
+not present in Config.json
+*/
+func DefaultConfig() Config {
+	return Config{
+		ApplicationConfig: ApplicationConfig{
+			ShutdownTimeoutSeconds: 10,
+		},
+		LoggingConfig: LoggingConfig{
+			LoggingLevel:         "Info",
+			LogToFile:            false,
+			LogToConsole:         true,
+			MessageBufferSize:    1024,
+			LogDirectory:         ".",
+			LogFileName:          "Go_TCP_Websocket_Adapter.txt",
+			MaxFileSizeMB:        10,
+			MaxFileAgeHours:      24,
+			MaxRetainedFiles:     10,
+			CompressRotatedFiles: false,
+		},
+		TCPRxConfig: TCPRxConfig{
+			Port:                  10010,
+			MaxConnections:        16,
+			MaxFrameSizeBytes:     4096,
+			SessionTimeoutSeconds: 10,
+			TLSCertificateFile:    "",
+			TLSKeyFile:            "",
+			ClientCAFile:          "",
+		},
+		UDPRxConfig: UDPRxConfig{
+			Enabled:               false,
+			Port:                  10011,
+			MaxFrameSizeBytes:     4096,
+			SessionTimeoutSeconds: 10,
+			ReorderWindow:         16,
+		},
+		WebSocketTxConfig: WebSocketTxConfig{
+			Port:                        10100,
+			RegisteredChunks:            []string{"TimeChunk", "FFTMagnitudeChunk"},
+			TLSCertificateFile:          "",
+			TLSKeyFile:                  "",
+			HTTPRedirectPort:            0,
+			AllowedOrigins:              []string{"*"},
+			AccessTokens:                []AccessToken{},
+			PublicMetrics:               true,
+			EnableCompression:           false,
+			CompressionLevel:            1,
+			CompressionThresholdBytes:   1024,
+			ReadBufferSize:              1024,
+			WriteBufferSize:             1024,
+			DefaultMaxMessagesPerSecond: 0,
+			MaxMessagesPerSecond:        map[string]FlexibleInt{},
+			ClientQueueSize:             100,
+			SlowClientPolicy:            string(SlowClientDropNewest),
+			WriteTimeoutSeconds:         10,
+			KeepaliveTimeoutSeconds:     60,
+		},
+		RecorderConfig: RecorderConfig{
+			Enabled:              false,
+			Directory:            "Recordings",
+			FileName:             "Recording-{timestamp}.ndjson",
+			MaxFileSizeMB:        100,
+			MaxFileAgeHours:      1,
+			MaxRetainedFiles:     0,
+			CompressRotatedFiles: true,
+			ChunkBufferSize:      1000,
+		},
+	}
+}
+
+///
+///			FLEXIBLE JSON TYPES
+///
+
+/*
+FlexibleBool accepts either a JSON boolean or a string such as "True"
+*/
+type FlexibleBool bool
+
+func (b *FlexibleBool) UnmarshalJSON(data []byte) error {
+	var value bool
+	if err := json.Unmarshal(data, &value); err == nil {
+		*b = FlexibleBool(value)
+		return nil
+	}
+
+	var strValue string
+	if err := json.Unmarshal(data, &strValue); err != nil {
+		return fmt.Errorf("expected a boolean, got %s", data)
+	}
+
+	value, err := strconv.ParseBool(strings.TrimSpace(strValue))
+	if err != nil {
+		return fmt.Errorf("expected a boolean, got %q", strValue)
+	}
+	*b = FlexibleBool(value)
+	return nil
+}
+
+/*
+FlexibleInt accepts either a JSON number or a string such as "10010"
+*/
+type FlexibleInt int
+
+func (i *FlexibleInt) UnmarshalJSON(data []byte) error {
+	var value int
+	if err := json.Unmarshal(data, &value); err == nil {
+		*i = FlexibleInt(value)
+		return nil
+	}
+
+	var strValue string
+	if err := json.Unmarshal(data, &strValue); err != nil {
+		return fmt.Errorf("expected an integer, got %s", data)
+	}
+
+	value, err := strconv.Atoi(strings.TrimSpace(strValue))
+	if err != nil {
+		return fmt.Errorf("expected an integer, got %q", strValue)
+	}
+	*i = FlexibleInt(value)
+	return nil
+}
+
+/*
+String returns the integer in decimal form, as used when building addresses
+*/
+func (i FlexibleInt) String() string {
+	return strconv.Itoa(int(i))
+}
+
+///
+///			CONFIGURATION ERRORS
+///
+
+/*
+ConfigError describes a single problem with a configuration field
+*/
+type ConfigError struct {
+	Path    string // Dotted path to the field, e.g. TCPRxConfig.Port
+	Problem string // What is wrong with the field
+}
+
+func (e ConfigError) Error() string {
+	return e.Path + ": " + e.Problem
+}
+
+/*
+ConfigErrors collects every problem found while loading a configuration
+so they can all be reported at once
+*/
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	problems := make([]string, len(e))
+	for index, configError := range e {
+		problems[index] = configError.Error()
+	}
+	return "invalid configuration:\n  " + strings.Join(problems, "\n  ")
+}
+
+func (e *ConfigErrors) add(path string, format string, args ...interface{}) {
+	*e = append(*e, ConfigError{Path: path, Problem: fmt.Sprintf(format, args...)})
+}
+
+///
+///			LOADING AND VALIDATION
+///
+
+/*
+LoadConfig reads the JSON file at the given path on top of DefaultConfig
+and validates the result. Any problems are returned together as ConfigErrors
+*/
+func LoadConfig(path string) (Config, error) {
+
+	config := DefaultConfig()
+
+	fileBytes, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	// Fields that fail to decode keep their default value
+	// so validating afterwards does not report them twice
+	var configErrors ConfigErrors
+	decodeSection(fileBytes, "", reflect.ValueOf(&config).Elem(), &configErrors)
+	if err := config.Validate(); err != nil {
+		configErrors = append(configErrors, err.(ConfigErrors)...)
+	}
+
+	if len(configErrors) > 0 {
+		return config, configErrors
+	}
+	return config, nil
+}
+
+/*
+decodeSection decodes a JSON object field by field into the struct held
+in target so that a bad field does not stop the remaining fields being
+checked. Nested structs are decoded in the same way
+*/
+func decodeSection(data []byte, path string, target reflect.Value, configErrors *ConfigErrors) {
+
+	var rawFields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &rawFields); err != nil {
+		configErrors.add(pathOrRoot(path), "expected a JSON object")
+		return
+	}
+
+	// Go through each field the struct knows about
+	targetType := target.Type()
+	knownFields := make(map[string]bool)
+	for index := 0; index < targetType.NumField(); index++ {
+		field := targetType.Field(index)
+		knownFields[field.Name] = true
+
+		rawField, exists := rawFields[field.Name]
+		if !exists {
+			continue
+		}
+
+		fieldPath := joinPath(path, field.Name)
+		fieldValue := target.Field(index)
+		if field.Type.Kind() == reflect.Struct {
+			decodeSection(rawField, fieldPath, fieldValue, configErrors)
+		} else if err := json.Unmarshal(rawField, fieldValue.Addr().Interface()); err != nil {
+			configErrors.add(fieldPath, "%s", describeDecodeError(err))
+		}
+	}
+
+	// Then report any fields it does not, which are most likely typos
+	var unknownFields []string
+	for fieldName := range rawFields {
+		if !knownFields[fieldName] {
+			unknownFields = append(unknownFields, fieldName)
+		}
+	}
+	sort.Strings(unknownFields)
+	for _, fieldName := range unknownFields {
+		configErrors.add(joinPath(path, fieldName), "unknown field")
+	}
+}
+
+func describeDecodeError(err error) string {
+	if typeError, isTypeError := err.(*json.UnmarshalTypeError); isTypeError {
+		return "expected " + typeError.Type.String() + ", got JSON " + typeError.Value
+	}
+	return err.Error()
+}
+
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func pathOrRoot(path string) string {
+	if path == "" {
+		return "(root)"
+	}
+	return path
+}
+
+/*
+Validate checks the values of every field and returns all problems found
+*/
+func (c Config) Validate() error {
+
+	var configErrors ConfigErrors
+
+	// Application
+	if c.ApplicationConfig.ShutdownTimeoutSeconds < 1 {
+		configErrors.add("ApplicationConfig.ShutdownTimeoutSeconds", "must be at least 1, got %d", c.ApplicationConfig.ShutdownTimeoutSeconds)
+	}
+	chunkTypeIdentifierNames := make(map[FlexibleInt]string)
+	for _, chunkType := range sortedKeys(c.ApplicationConfig.ChunkTypeIdentifiers) {
+		identifier := c.ApplicationConfig.ChunkTypeIdentifiers[chunkType]
+		identifierPath := "ApplicationConfig.ChunkTypeIdentifiers." + chunkType
+		if identifier < 0 || int64(identifier) > math.MaxUint32 {
+			configErrors.add(identifierPath, "must be between 0 and %d, got %d", uint32(math.MaxUint32), identifier)
+		} else if otherChunkType, exists := chunkTypeIdentifierNames[identifier]; exists {
+			configErrors.add(identifierPath, "identifier %d is already used by %s", identifier, otherChunkType)
+		}
+		chunkTypeIdentifierNames[identifier] = chunkType
+	}
+
+	// Logging
+	if _, valid := ParseLoggingLevel(c.LoggingConfig.LoggingLevel); !valid {
+		configErrors.add("LoggingConfig.LoggingLevel", "%q is not one of Debug, Info, Warning or Error", c.LoggingConfig.LoggingLevel)
+	}
+	if c.LoggingConfig.MessageBufferSize < 1 {
+		configErrors.add("LoggingConfig.MessageBufferSize", "must be at least 1, got %d", c.LoggingConfig.MessageBufferSize)
+	}
+	if c.LoggingConfig.LogDirectory == "" {
+		configErrors.add("LoggingConfig.LogDirectory", "must not be empty")
+	}
+	validateFileNamePattern(&configErrors, "LoggingConfig.LogFileName", c.LoggingConfig.LogFileName)
+	if c.LoggingConfig.MaxFileSizeMB < 0 {
+		configErrors.add("LoggingConfig.MaxFileSizeMB", "must not be negative, got %d", c.LoggingConfig.MaxFileSizeMB)
+	}
+	if c.LoggingConfig.MaxFileAgeHours < 0 {
+		configErrors.add("LoggingConfig.MaxFileAgeHours", "must not be negative, got %d", c.LoggingConfig.MaxFileAgeHours)
+	}
+	if c.LoggingConfig.MaxRetainedFiles < 0 {
+		configErrors.add("LoggingConfig.MaxRetainedFiles", "must not be negative, got %d", c.LoggingConfig.MaxRetainedFiles)
+	}
+
+	// TCP receiver
+	validatePort(&configErrors, "TCPRxConfig.Port", c.TCPRxConfig.Port)
+	if c.TCPRxConfig.MaxConnections < 1 {
+		configErrors.add("TCPRxConfig.MaxConnections", "must be at least 1, got %d", c.TCPRxConfig.MaxConnections)
+	}
+	if c.TCPRxConfig.MaxFrameSizeBytes < FrameHeaderSize || c.TCPRxConfig.MaxFrameSizeBytes > 65535 {
+		configErrors.add("TCPRxConfig.MaxFrameSizeBytes", "must be between %d and 65535, got %d", FrameHeaderSize, c.TCPRxConfig.MaxFrameSizeBytes)
+	}
+	if c.TCPRxConfig.SessionTimeoutSeconds < 1 {
+		configErrors.add("TCPRxConfig.SessionTimeoutSeconds", "must be at least 1, got %d", c.TCPRxConfig.SessionTimeoutSeconds)
+	}
+	if (c.TCPRxConfig.TLSCertificateFile == "") != (c.TCPRxConfig.TLSKeyFile == "") {
+		configErrors.add("TCPRxConfig.TLSKeyFile", "TLSCertificateFile and TLSKeyFile must be given together")
+	}
+	if c.TCPRxConfig.ClientCAFile != "" && c.TCPRxConfig.TLSCertificateFile == "" {
+		configErrors.add("TCPRxConfig.ClientCAFile", "requires TLSCertificateFile and TLSKeyFile")
+	}
+
+	// UDP receiver
+	validatePort(&configErrors, "UDPRxConfig.Port", c.UDPRxConfig.Port)
+	if c.UDPRxConfig.MaxFrameSizeBytes < FrameHeaderSize || c.UDPRxConfig.MaxFrameSizeBytes > 65535 {
+		configErrors.add("UDPRxConfig.MaxFrameSizeBytes", "must be between %d and 65535, got %d", FrameHeaderSize, c.UDPRxConfig.MaxFrameSizeBytes)
+	}
+	if c.UDPRxConfig.SessionTimeoutSeconds < 1 {
+		configErrors.add("UDPRxConfig.SessionTimeoutSeconds", "must be at least 1, got %d", c.UDPRxConfig.SessionTimeoutSeconds)
+	}
+	if c.UDPRxConfig.ReorderWindow < 0 {
+		configErrors.add("UDPRxConfig.ReorderWindow", "must not be negative, got %d", c.UDPRxConfig.ReorderWindow)
+	}
+
+	// WebSocket transmitter
+	validatePort(&configErrors, "WebSocketTxConfig.Port", c.WebSocketTxConfig.Port)
+	seenChunkTypes := make(map[string]bool)
+	for index, chunkType := range c.WebSocketTxConfig.RegisteredChunks {
+		chunkTypePath := fmt.Sprintf("WebSocketTxConfig.RegisteredChunks[%d]", index)
+		if chunkType == "" {
+			configErrors.add(chunkTypePath, "chunk type must not be empty")
+		} else if seenChunkTypes[chunkType] {
+			configErrors.add(chunkTypePath, "chunk type %q is registered more than once", chunkType)
+		}
+		seenChunkTypes[chunkType] = true
+	}
+
+	if c.TCPRxConfig.Port == c.WebSocketTxConfig.Port {
+		configErrors.add("WebSocketTxConfig.Port", "must differ from TCPRxConfig.Port")
+	}
+	if (c.WebSocketTxConfig.TLSCertificateFile == "") != (c.WebSocketTxConfig.TLSKeyFile == "") {
+		configErrors.add("WebSocketTxConfig.TLSKeyFile", "TLSCertificateFile and TLSKeyFile must be given together")
+	}
+	if c.WebSocketTxConfig.HTTPRedirectPort != 0 {
+		validatePort(&configErrors, "WebSocketTxConfig.HTTPRedirectPort", c.WebSocketTxConfig.HTTPRedirectPort)
+		if c.WebSocketTxConfig.TLSCertificateFile == "" {
+			configErrors.add("WebSocketTxConfig.HTTPRedirectPort", "requires TLSCertificateFile and TLSKeyFile")
+		}
+		if c.WebSocketTxConfig.HTTPRedirectPort == c.WebSocketTxConfig.Port || c.WebSocketTxConfig.HTTPRedirectPort == c.TCPRxConfig.Port {
+			configErrors.add("WebSocketTxConfig.HTTPRedirectPort", "must differ from WebSocketTxConfig.Port and TCPRxConfig.Port")
+		}
+	}
+
+	if c.WebSocketTxConfig.CompressionLevel < flate.HuffmanOnly || c.WebSocketTxConfig.CompressionLevel > flate.BestCompression {
+		configErrors.add("WebSocketTxConfig.CompressionLevel", "must be between %d and %d, got %d", flate.HuffmanOnly, flate.BestCompression, c.WebSocketTxConfig.CompressionLevel)
+	}
+	if c.WebSocketTxConfig.CompressionThresholdBytes < 0 {
+		configErrors.add("WebSocketTxConfig.CompressionThresholdBytes", "must not be negative, got %d", c.WebSocketTxConfig.CompressionThresholdBytes)
+	}
+	if c.WebSocketTxConfig.ReadBufferSize < 0 {
+		configErrors.add("WebSocketTxConfig.ReadBufferSize", "must not be negative, got %d", c.WebSocketTxConfig.ReadBufferSize)
+	}
+	if c.WebSocketTxConfig.WriteBufferSize < 0 {
+		configErrors.add("WebSocketTxConfig.WriteBufferSize", "must not be negative, got %d", c.WebSocketTxConfig.WriteBufferSize)
+	}
+	if c.WebSocketTxConfig.DefaultMaxMessagesPerSecond < 0 {
+		configErrors.add("WebSocketTxConfig.DefaultMaxMessagesPerSecond", "must not be negative, got %d", c.WebSocketTxConfig.DefaultMaxMessagesPerSecond)
+	}
+	for _, chunkType := range sortedKeys(c.WebSocketTxConfig.MaxMessagesPerSecond) {
+		ratePath := "WebSocketTxConfig.MaxMessagesPerSecond." + chunkType
+		if !seenChunkTypes[chunkType] {
+			configErrors.add(ratePath, "chunk type %q is not registered", chunkType)
+		}
+		if c.WebSocketTxConfig.MaxMessagesPerSecond[chunkType] < 0 {
+			configErrors.add(ratePath, "must not be negative, got %d", c.WebSocketTxConfig.MaxMessagesPerSecond[chunkType])
+		}
+	}
+	if c.WebSocketTxConfig.ClientQueueSize < 1 {
+		configErrors.add("WebSocketTxConfig.ClientQueueSize", "must be at least 1, got %d", c.WebSocketTxConfig.ClientQueueSize)
+	}
+	if _, err := ParseSlowClientPolicy(c.WebSocketTxConfig.SlowClientPolicy); err != nil {
+		configErrors.add("WebSocketTxConfig.SlowClientPolicy", "%q must be one of DropNewest, DropOldest or Disconnect", c.WebSocketTxConfig.SlowClientPolicy)
+	}
+	if c.WebSocketTxConfig.WriteTimeoutSeconds < 1 {
+		configErrors.add("WebSocketTxConfig.WriteTimeoutSeconds", "must be at least 1, got %d", c.WebSocketTxConfig.WriteTimeoutSeconds)
+	}
+	if c.WebSocketTxConfig.KeepaliveTimeoutSeconds < 0 {
+		configErrors.add("WebSocketTxConfig.KeepaliveTimeoutSeconds", "must not be negative, got %d", c.WebSocketTxConfig.KeepaliveTimeoutSeconds)
+	}
+	for index, origin := range c.WebSocketTxConfig.AllowedOrigins {
+		originPath := fmt.Sprintf("WebSocketTxConfig.AllowedOrigins[%d]", index)
+		if origin == anyOrigin {
+			continue
+		}
+		if originURL, err := url.Parse(origin); err != nil || originURL.Scheme == "" || originURL.Host == "" {
+			configErrors.add(originPath, "%q must be \"*\" or a scheme and host such as https://example.com", origin)
+		}
+	}
+	seenTokens := make(map[string]bool)
+	for index, accessToken := range c.WebSocketTxConfig.AccessTokens {
+		tokenPath := fmt.Sprintf("WebSocketTxConfig.AccessTokens[%d]", index)
+		if accessToken.Token == "" {
+			configErrors.add(tokenPath+".Token", "must not be empty")
+		} else if seenTokens[accessToken.Token] {
+			configErrors.add(tokenPath+".Token", "is the same as an earlier token")
+		}
+		seenTokens[accessToken.Token] = true
+		for _, chunkType := range accessToken.ChunkTypes {
+			if !seenChunkTypes[chunkType] {
+				configErrors.add(tokenPath+".ChunkTypes", "chunk type %q is not registered", chunkType)
+			}
+		}
+	}
+
+	// Recorder
+	if c.RecorderConfig.Directory == "" {
+		configErrors.add("RecorderConfig.Directory", "must not be empty")
+	}
+	validateFileNamePattern(&configErrors, "RecorderConfig.FileName", c.RecorderConfig.FileName)
+	if c.RecorderConfig.MaxFileSizeMB < 0 {
+		configErrors.add("RecorderConfig.MaxFileSizeMB", "must not be negative, got %d", c.RecorderConfig.MaxFileSizeMB)
+	}
+	if c.RecorderConfig.MaxFileAgeHours < 0 {
+		configErrors.add("RecorderConfig.MaxFileAgeHours", "must not be negative, got %d", c.RecorderConfig.MaxFileAgeHours)
+	}
+	if c.RecorderConfig.MaxRetainedFiles < 0 {
+		configErrors.add("RecorderConfig.MaxRetainedFiles", "must not be negative, got %d", c.RecorderConfig.MaxRetainedFiles)
+	}
+	if c.RecorderConfig.ChunkBufferSize < 1 {
+		configErrors.add("RecorderConfig.ChunkBufferSize", "must be at least 1, got %d", c.RecorderConfig.ChunkBufferSize)
+	}
+
+	if len(configErrors) > 0 {
+		return configErrors
+	}
+	return nil
+}
+
+func sortedKeys(stringMap map[string]FlexibleInt) []string {
+	keys := make([]string, 0, len(stringMap))
+	for key := range stringMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func validatePort(configErrors *ConfigErrors, path string, port FlexibleInt) {
+	if port < 1 || port > 65535 {
+		configErrors.add(path, "must be between 1 and 65535, got %d", port)
+	}
+}
+
+func validateFileNamePattern(configErrors *ConfigErrors, path string, fileNamePattern string) {
+	if fileNamePattern == "" {
+		configErrors.add(path, "must not be empty")
+	} else if filepath.Base(fileNamePattern) != fileNamePattern {
+		configErrors.add(path, "%q must be a file name without a directory", fileNamePattern)
+	} else if strings.Count(fileNamePattern, FileNameTimestampPlaceholder) > 1 {
+		configErrors.add(path, "%q must not hold %s more than once", fileNamePattern, FileNameTimestampPlaceholder)
+	}
+}
@@ -0,0 +1,185 @@
+package Routines
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Expected byte Format
+// |Transport Header(2)| [Session Header(23)|Session Data(x)] |
+//
+// The transport header holds the little endian length of the whole
+// frame, including the transport header itself
+const (
+	TransportLayerHeaderSize = 2
+	SessionLayerHeaderSize   = 23
+	FrameHeaderSize          = TransportLayerHeaderSize + SessionLayerHeaderSize
+)
+
+var (
+	ErrFrameTooShort = errors.New("frame length is shorter than the frame headers")
+	ErrFrameTooLong  = errors.New("frame length exceeds the maximum frame size")
+
+	errInvalidTransmissionState = errors.New("transmission state is neither 0 nor 1")
+)
+
+/*
+FrameSyncError is returned when the decoder finds a corrupt frame length
+and has to discard bytes to find the start of the next frame
+*/
+type FrameSyncError struct {
+	FrameLength    uint16 // The first corrupt length that was found
+	DiscardedBytes int    // How many bytes were dropped while resynchronising
+	Err            error  // Why the length was rejected
+}
+
+func (e *FrameSyncError) Error() string {
+	return fmt.Sprintf("corrupt frame length %d (%s), discarded %d bytes to resynchronise", e.FrameLength, e.Err, e.DiscardedBytes)
+}
+
+func (e *FrameSyncError) Unwrap() error {
+	return e.Err
+}
+
+/*
+Frame is a single complete transport layer frame. Both slices are owned
+by the frame and remain valid after further decoding
+*/
+type Frame struct {
+	SessionHeaderBytes []byte // The 23 session header bytes
+	SessionData        []byte // The session data following the header
+}
+
+/*
+AppendFrame appends a complete frame holding the session header and
+data, the reverse of FrameDecoder.Next. The frame must not exceed the
+65535 bytes the transport header can describe
+*/
+func AppendFrame(byteArray []byte, sessionHeader SessionHeader, sessionData []byte) []byte {
+	frameLength := FrameHeaderSize + len(sessionData)
+	byteArray = binary.LittleEndian.AppendUint16(byteArray, uint16(frameLength))
+	byteArray = AppendSessionHeader(byteArray, sessionHeader)
+	return append(byteArray, sessionData...)
+}
+
+/*
+FrameDecoder accumulates bytes from a stream and splits them into frames
+as soon as each one is complete
+*/
+type FrameDecoder struct {
+	buffer          []byte // Bytes received but not yet consumed
+	maxFrameSize    int    // Largest frame length accepted as valid
+	resynchronising bool   // A corrupt length was found and no valid header since
+}
+
+/*
+Create a decoder that treats any frame longer than maxFrameSize as corrupt
+*/
+func NewFrameDecoder(maxFrameSize int) *FrameDecoder {
+	frameDecoder := new(FrameDecoder)
+	frameDecoder.maxFrameSize = maxFrameSize
+	return frameDecoder
+}
+
+/*
+Append received bytes to the decoder
+*/
+func (d *FrameDecoder) Write(data []byte) {
+	d.buffer = append(d.buffer, data...)
+}
+
+/*
+Number of bytes held that do not yet form a complete frame
+*/
+func (d *FrameDecoder) Buffered() int {
+	return len(d.buffer)
+}
+
+/*
+Next consumes exactly one frame if a complete one is buffered.
+
+returns the frame and true if one was consumed, false if more bytes are
+needed, or a FrameSyncError if corrupt bytes had to be discarded. Next
+should be called again after an error as a frame may now be available
+*/
+func (d *FrameDecoder) Next() (Frame, bool, error) {
+
+	// Skip forward one byte at a time until we find a plausible length.
+	// While resynchronising we also require a valid transmission state
+	// so that stray bytes are less likely to look like a header. This
+	// holds across calls as reads may end part way through resynchronising
+	var syncError *FrameSyncError
+	for len(d.buffer) >= TransportLayerHeaderSize {
+		frameLength := binary.LittleEndian.Uint16(d.buffer[:TransportLayerHeaderSize])
+		lengthError := d.checkFrameLength(frameLength)
+		if lengthError == nil && !d.resynchronising {
+			break
+		} else if lengthError == nil {
+			if len(d.buffer) == TransportLayerHeaderSize {
+				break
+			}
+			if d.buffer[TransportLayerHeaderSize] <= 1 {
+				d.resynchronising = false
+				break
+			}
+			lengthError = errInvalidTransmissionState
+		}
+
+		if syncError == nil {
+			syncError = &FrameSyncError{FrameLength: frameLength, Err: lengthError}
+		}
+		syncError.DiscardedBytes++
+		d.resynchronising = true
+		d.buffer = d.buffer[1:]
+	}
+
+	if syncError != nil {
+		d.compact()
+		return Frame{}, false, syncError
+	}
+
+	// Then wait until the whole frame has arrived, or until the
+	// transmission state of a possible header can be checked
+	if len(d.buffer) < TransportLayerHeaderSize || d.resynchronising {
+		return Frame{}, false, nil
+	}
+	frameLength := int(binary.LittleEndian.Uint16(d.buffer[:TransportLayerHeaderSize]))
+	if len(d.buffer) < frameLength {
+		return Frame{}, false, nil
+	}
+
+	// And copy it out so the buffer can be reused
+	frameBytes := make([]byte, frameLength-TransportLayerHeaderSize)
+	copy(frameBytes, d.buffer[TransportLayerHeaderSize:frameLength])
+	d.buffer = d.buffer[frameLength:]
+	d.compact()
+
+	frame := Frame{
+		SessionHeaderBytes: frameBytes[:SessionLayerHeaderSize],
+		SessionData:        frameBytes[SessionLayerHeaderSize:],
+	}
+	return frame, true, nil
+}
+
+func (d *FrameDecoder) checkFrameLength(frameLength uint16) error {
+	if int(frameLength) < FrameHeaderSize {
+		return ErrFrameTooShort
+	}
+	if int(frameLength) > d.maxFrameSize {
+		return ErrFrameTooLong
+	}
+	return nil
+}
+
+/*
+Move unconsumed bytes to the start of the buffer once it is mostly
+consumed so it does not grow without bound
+*/
+func (d *FrameDecoder) compact() {
+	if len(d.buffer) == 0 {
+		d.buffer = d.buffer[:0:0]
+	} else if len(d.buffer) < cap(d.buffer)/2 {
+		d.buffer = append([]byte(nil), d.buffer...)
+	}
+}
@@ -0,0 +1,171 @@
+package Routines
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+const testMaxFrameSize = 4096
+
+func testFrames() ([]SessionHeader, [][]byte) {
+	sessionHeaders := []SessionHeader{
+		{TransmissionState: 0, SessionNumber: 7, SequenceNumber: 0, ChunkType: 1, SourceIdentifier: SourceIdentifier{2, 0, 0, 0, 0, 1}},
+		{TransmissionState: 1, SessionNumber: 7, SequenceNumber: 1, ChunkType: 1, SourceIdentifier: SourceIdentifier{2, 0, 0, 0, 0, 1}, TrailingBytes: [4]byte{1, 2, 3, 4}},
+	}
+	sessionData := [][]byte{[]byte(`{"TimeChunk":`), []byte(`{"Channels":[[1,2,3]]}}`)}
+	return sessionHeaders, sessionData
+}
+
+func appendTestFrames(byteArray []byte) []byte {
+	sessionHeaders, sessionData := testFrames()
+	for index := range sessionHeaders {
+		byteArray = AppendFrame(byteArray, sessionHeaders[index], sessionData[index])
+	}
+	return byteArray
+}
+
+/*
+Call Next until no frame is available, collecting frames and sync errors
+*/
+func drainFrames(t *testing.T, frameDecoder *FrameDecoder) ([]Frame, []*FrameSyncError) {
+	t.Helper()
+
+	var frames []Frame
+	var syncErrors []*FrameSyncError
+	for {
+		frame, complete, err := frameDecoder.Next()
+		if err != nil {
+			var syncError *FrameSyncError
+			if !errors.As(err, &syncError) {
+				t.Fatalf("Next returned %v, want a *FrameSyncError", err)
+			}
+			syncErrors = append(syncErrors, syncError)
+			continue
+		}
+		if !complete {
+			return frames, syncErrors
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func checkTestFrames(t *testing.T, frames []Frame) {
+	t.Helper()
+
+	sessionHeaders, sessionData := testFrames()
+	if len(frames) != len(sessionHeaders) {
+		t.Fatalf("decoded %d frames, want %d", len(frames), len(sessionHeaders))
+	}
+	for index, frame := range frames {
+		if sessionHeader := ParseSessionHeader(frame.SessionHeaderBytes); sessionHeader != sessionHeaders[index] {
+			t.Errorf("frame %d header is %+v, want %+v", index, sessionHeader, sessionHeaders[index])
+		}
+		if !bytes.Equal(frame.SessionData, sessionData[index]) {
+			t.Errorf("frame %d data is %q, want %q", index, frame.SessionData, sessionData[index])
+		}
+	}
+}
+
+func TestFrameDecoderRoundTrip(t *testing.T) {
+	sessionHeaders, sessionData := testFrames()
+	for index := range sessionHeaders {
+		frameDecoder := NewFrameDecoder(testMaxFrameSize)
+		frameDecoder.Write(AppendFrame(nil, sessionHeaders[index], sessionData[index]))
+
+		frame, complete, err := frameDecoder.Next()
+		if err != nil || !complete {
+			t.Fatalf("Next returned %v, %v, want a frame", complete, err)
+		}
+		if sessionHeader := ParseSessionHeader(frame.SessionHeaderBytes); sessionHeader != sessionHeaders[index] {
+			t.Errorf("header is %+v, want %+v", sessionHeader, sessionHeaders[index])
+		}
+		if !bytes.Equal(frame.SessionData, sessionData[index]) {
+			t.Errorf("data is %q, want %q", frame.SessionData, sessionData[index])
+		}
+		if frameDecoder.Buffered() != 0 {
+			t.Errorf("%d bytes left buffered, want 0", frameDecoder.Buffered())
+		}
+	}
+}
+
+func TestFrameDecoderSeveralFramesInOneRead(t *testing.T) {
+	frameDecoder := NewFrameDecoder(testMaxFrameSize)
+	frameDecoder.Write(appendTestFrames(nil))
+
+	frames, syncErrors := drainFrames(t, frameDecoder)
+	if len(syncErrors) != 0 {
+		t.Fatalf("got %d sync errors, want 0", len(syncErrors))
+	}
+	checkTestFrames(t, frames)
+}
+
+func TestFrameDecoderSplitAtEveryByte(t *testing.T) {
+	byteArray := appendTestFrames(nil)
+	for split := 0; split <= len(byteArray); split++ {
+		frameDecoder := NewFrameDecoder(testMaxFrameSize)
+
+		frameDecoder.Write(byteArray[:split])
+		frames, syncErrors := drainFrames(t, frameDecoder)
+		frameDecoder.Write(byteArray[split:])
+		remainingFrames, remainingSyncErrors := drainFrames(t, frameDecoder)
+
+		if len(syncErrors)+len(remainingSyncErrors) != 0 {
+			t.Fatalf("split at %d: got sync errors, want none", split)
+		}
+		checkTestFrames(t, append(frames, remainingFrames...))
+	}
+}
+
+func TestFrameDecoderCorruptLengths(t *testing.T) {
+	testCases := []struct {
+		name        string
+		corruptData []byte
+		wantErr     error
+	}{
+		{"too short", []byte{0x03, 0x00}, ErrFrameTooShort},
+		{"too long", []byte{0xff, 0xff}, ErrFrameTooLong},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			frameDecoder := NewFrameDecoder(testMaxFrameSize)
+			frameDecoder.Write(appendTestFrames(append([]byte(nil), testCase.corruptData...)))
+
+			frames, syncErrors := drainFrames(t, frameDecoder)
+			if len(syncErrors) == 0 {
+				t.Fatal("got no sync error, want one")
+			}
+			if !errors.Is(syncErrors[0], testCase.wantErr) {
+				t.Errorf("sync error is %v, want %v", syncErrors[0], testCase.wantErr)
+			}
+			if syncErrors[0].DiscardedBytes != len(testCase.corruptData) {
+				t.Errorf("discarded %d bytes, want %d", syncErrors[0].DiscardedBytes, len(testCase.corruptData))
+			}
+			checkTestFrames(t, frames)
+		})
+	}
+}
+
+func TestFrameDecoderResynchronisesAcrossReads(t *testing.T) {
+	// 0x07ff is a plausible length, but is only reached while resynchronising
+	byteArray := appendTestFrames([]byte{0xff, 0xff, 0x07, 0x09})
+
+	for split := 0; split <= len(byteArray); split++ {
+		frameDecoder := NewFrameDecoder(testMaxFrameSize)
+
+		frameDecoder.Write(byteArray[:split])
+		frames, syncErrors := drainFrames(t, frameDecoder)
+		frameDecoder.Write(byteArray[split:])
+		remainingFrames, remainingSyncErrors := drainFrames(t, frameDecoder)
+
+		discardedBytes := 0
+		for _, syncError := range append(syncErrors, remainingSyncErrors...) {
+			discardedBytes += syncError.DiscardedBytes
+		}
+		if discardedBytes != 4 {
+			t.Errorf("split at %d: discarded %d bytes, want 4", split, discardedBytes)
+		}
+		checkTestFrames(t, append(frames, remainingFrames...))
+	}
+}
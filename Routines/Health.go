@@ -0,0 +1,231 @@
+package Routines
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+///
+///			ROUTINE HEALTH
+///
+
+// Names under which each routine reports its status
+const (
+	LoggingRoutineName      = "Logging"
+	TCPRxRoutineName        = "TCPRx"
+	UDPRxRoutineName        = "UDPRx"
+	WebSocketTxRoutineName  = "WebSocketTx"
+	ChunkRoutingRoutineName = "ChunkRouting"
+)
+
+/*
+How often the logging routine reports that it is still processing messages,
+and how long without a report before it is considered stuck
+*/
+const (
+	LoggingHeartbeatInterval = 5 * time.Second
+	LoggingHeartbeatTimeout  = 3 * LoggingHeartbeatInterval
+)
+
+type RoutineState string
+
+const (
+	RoutineStarting RoutineState = "Starting"
+	RoutineRunning  RoutineState = "Running"
+	RoutineStopped  RoutineState = "Stopped"
+	RoutineFailed   RoutineState = "Failed"
+)
+
+/*
+RoutineStatus is the last reported state of a single routine
+*/
+type RoutineStatus struct {
+	State         RoutineState
+	Since         time.Time  // When the routine entered this state
+	Detail        string     `json:",omitempty"` // Such as the address bound or the error that occurred
+	LastHeartbeat *time.Time `json:",omitempty"` // Only reported by routines that send heartbeats
+}
+
+/*
+HealthReport is the JSON body served by the health endpoints
+*/
+type HealthReport struct {
+	Status             string                   // "ok" or a short description of the problem
+	Routines           map[string]RoutineStatus // Status of every routine that has reported
+	ConnectedProducers int64                    // TCP producers currently connected
+	LastChunkTime      *time.Time               `json:",omitempty"` // When the last complete chunk arrived
+}
+
+/*
+Routine safe record of the state of every routine, used to answer
+liveness and readiness probes
+*/
+type RoutineHealth struct {
+	mu                 sync.RWMutex              // Mutex to protect access to the map
+	routineStatusMap   map[string]*RoutineStatus // Map of routine names and their status
+	connectedProducers int64                     // Number of TCP producers connected
+	lastChunkUnixNano  int64                     // Arrival time of the last complete chunk
+	readinessRoutines  []string                  // Routines that must be running to be ready
+}
+
+func NewRoutineHealth() *RoutineHealth {
+	routineHealth := new(RoutineHealth)
+	routineHealth.routineStatusMap = make(map[string]*RoutineStatus)
+	routineHealth.readinessRoutines = []string{TCPRxRoutineName, WebSocketTxRoutineName}
+	return routineHealth
+}
+
+/*
+Choose the routines that must be running before the application is
+ready, the TCP receiver and WebSocket router by default
+*/
+func (h *RoutineHealth) SetReadinessRoutines(routineNames ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.readinessRoutines = append([]string(nil), routineNames...)
+}
+
+/*
+Record that a routine has moved to a new state
+*/
+func (h *RoutineHealth) SetRoutineState(routineName string, state RoutineState, detail string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	routineStatus, exists := h.routineStatusMap[routineName]
+	if !exists {
+		routineStatus = new(RoutineStatus)
+		h.routineStatusMap[routineName] = routineStatus
+	}
+	routineStatus.State = state
+	routineStatus.Since = time.Now()
+	routineStatus.Detail = detail
+}
+
+/*
+Record that a routine is still making progress
+*/
+func (h *RoutineHealth) Heartbeat(routineName string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if routineStatus, exists := h.routineStatusMap[routineName]; exists {
+		heartbeatTime := time.Now()
+		routineStatus.LastHeartbeat = &heartbeatTime
+	}
+}
+
+func (h *RoutineHealth) ProducerConnected() {
+	atomic.AddInt64(&h.connectedProducers, 1)
+}
+
+func (h *RoutineHealth) ProducerDisconnected() {
+	atomic.AddInt64(&h.connectedProducers, -1)
+}
+
+/*
+Record the arrival time of a complete chunk
+*/
+func (h *RoutineHealth) ChunkReceived(arrivalTime time.Time) {
+	atomic.StoreInt64(&h.lastChunkUnixNano, arrivalTime.UnixNano())
+}
+
+/*
+Report returns a copy of the current state of every routine
+*/
+func (h *RoutineHealth) Report() HealthReport {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	report := HealthReport{
+		Status:             "ok",
+		Routines:           make(map[string]RoutineStatus),
+		ConnectedProducers: atomic.LoadInt64(&h.connectedProducers),
+	}
+	for routineName, routineStatus := range h.routineStatusMap {
+		report.Routines[routineName] = *routineStatus
+	}
+	if lastChunkUnixNano := atomic.LoadInt64(&h.lastChunkUnixNano); lastChunkUnixNano != 0 {
+		lastChunkTime := time.Unix(0, lastChunkUnixNano)
+		report.LastChunkTime = &lastChunkTime
+	}
+	return report
+}
+
+/*
+Liveness requires that no routine has failed and that the logging
+routine is still working through its messages
+*/
+func (h *RoutineHealth) LivenessReport() (HealthReport, bool) {
+	report := h.Report()
+
+	for routineName, routineStatus := range report.Routines {
+		if routineStatus.State == RoutineFailed {
+			report.Status = routineName + " failed"
+			return report, false
+		}
+	}
+
+	loggingStatus, exists := report.Routines[LoggingRoutineName]
+	if !exists || loggingStatus.State != RoutineRunning {
+		report.Status = LoggingRoutineName + " is not running"
+		return report, false
+	}
+	if loggingStatus.LastHeartbeat == nil || time.Since(*loggingStatus.LastHeartbeat) > LoggingHeartbeatTimeout {
+		report.Status = LoggingRoutineName + " has stopped processing messages"
+		return report, false
+	}
+
+	return report, true
+}
+
+/*
+Readiness additionally requires the readiness routines, by default the
+TCP listener and the WebSocket router, to be running
+*/
+func (h *RoutineHealth) ReadinessReport() (HealthReport, bool) {
+	report, alive := h.LivenessReport()
+	if !alive {
+		return report, false
+	}
+
+	h.mu.RLock()
+	readinessRoutines := h.readinessRoutines
+	h.mu.RUnlock()
+
+	for _, routineName := range readinessRoutines {
+		if report.Routines[routineName].State != RoutineRunning {
+			report.Status = routineName + " is not running"
+			return report, false
+		}
+	}
+
+	return report, true
+}
+
+/*
+Add the /healthz and /readyz endpoints to a router
+*/
+func RegisterHealthPaths(router *gin.Engine, routineHealth *RoutineHealth) {
+
+	router.GET("/healthz", func(c *gin.Context) {
+		report, alive := routineHealth.LivenessReport()
+		c.JSON(healthStatusCode(alive), report)
+	})
+
+	router.GET("/readyz", func(c *gin.Context) {
+		report, ready := routineHealth.ReadinessReport()
+		c.JSON(healthStatusCode(ready), report)
+	})
+}
+
+func healthStatusCode(healthy bool) int {
+	if healthy {
+		return http.StatusOK
+	}
+	return http.StatusServiceUnavailable
+}
@@ -0,0 +1,197 @@
+package Routines
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+///
+///			STRUCTURED LOGGER
+///
+
+/*
+LogEntry is a single message waiting to be written by the logging routine
+*/
+type LogEntry struct {
+	Level   zerolog.Level // Severity of the message
+	Time    time.Time     // When the message was logged
+	Message string        // What happened
+	Fields  []interface{} // Alternating keys and values describing the message
+}
+
+/*
+The queue shared by a logger and every logger derived from it
+*/
+type logQueue struct {
+	mu           sync.RWMutex  // Mutex to protect sends against the channel closing
+	entryChannel chan LogEntry // Messages waiting for the logging routine
+	closed       bool          // Set once the channel has been closed
+	droppedCount atomic.Uint64 // Messages dropped because the buffer was full
+	level        atomic.Int32  // Messages below this level are discarded
+}
+
+/*
+Logger queues structured log messages for the logging routine without
+blocking the caller. Once the buffer is full further messages are
+dropped and counted. Loggers created with With share the queue of the
+logger they were created from and add their fields to every message
+*/
+type Logger struct {
+	queue  *logQueue
+	fields []interface{}
+}
+
+/*
+Create a logger whose buffer holds up to bufferSize messages and which
+discards messages below the given level
+*/
+func NewLogger(bufferSize int, level zerolog.Level) *Logger {
+	queue := new(logQueue)
+	queue.entryChannel = make(chan LogEntry, bufferSize)
+	queue.level.Store(int32(level))
+
+	logger := new(Logger)
+	logger.queue = queue
+	return logger
+}
+
+/*
+With returns a logger that adds the given alternating keys and values
+to every message it logs
+*/
+func (l *Logger) With(keyValues ...interface{}) *Logger {
+	logger := new(Logger)
+	logger.queue = l.queue
+	logger.fields = append(append([]interface{}(nil), l.fields...), normaliseLogFields(keyValues)...)
+	return logger
+}
+
+func (l *Logger) Debug(message string, keyValues ...interface{}) {
+	l.Log(zerolog.DebugLevel, message, keyValues...)
+}
+
+func (l *Logger) Info(message string, keyValues ...interface{}) {
+	l.Log(zerolog.InfoLevel, message, keyValues...)
+}
+
+func (l *Logger) Warn(message string, keyValues ...interface{}) {
+	l.Log(zerolog.WarnLevel, message, keyValues...)
+}
+
+func (l *Logger) Error(message string, keyValues ...interface{}) {
+	l.Log(zerolog.ErrorLevel, message, keyValues...)
+}
+
+/*
+Log queues a message with alternating keys and values describing it.
+The message is dropped if it is below the logger level, the buffer is
+full or the logger has been closed
+*/
+func (l *Logger) Log(level zerolog.Level, message string, keyValues ...interface{}) {
+	if level < l.Level() {
+		return
+	}
+
+	logEntry := LogEntry{
+		Level:   level,
+		Time:    time.Now(),
+		Message: message,
+		Fields:  append(append([]interface{}(nil), l.fields...), normaliseLogFields(keyValues)...),
+	}
+
+	l.queue.mu.RLock()
+	defer l.queue.mu.RUnlock()
+	if l.queue.closed {
+		return
+	}
+
+	select {
+	case l.queue.entryChannel <- logEntry:
+	default:
+		l.queue.droppedCount.Add(1)
+		metricLogMessagesDropped.Inc()
+	}
+}
+
+/*
+Level returns the level below which messages are discarded
+*/
+func (l *Logger) Level() zerolog.Level {
+	return zerolog.Level(l.queue.level.Load())
+}
+
+/*
+SetLevel changes the level below which messages are discarded for this
+logger and every logger sharing its queue
+*/
+func (l *Logger) SetLevel(level zerolog.Level) {
+	l.queue.level.Store(int32(level))
+}
+
+/*
+DroppedCount returns the number of messages dropped because the buffer was full
+*/
+func (l *Logger) DroppedCount() uint64 {
+	return l.queue.droppedCount.Load()
+}
+
+/*
+Close stops the logger accepting messages. The logging routine finishes
+once it has written every message already queued
+*/
+func (l *Logger) Close() {
+	l.queue.mu.Lock()
+	defer l.queue.mu.Unlock()
+	if !l.queue.closed {
+		l.queue.closed = true
+		close(l.queue.entryChannel)
+	}
+}
+
+/*
+Messages waiting for the logging routine, closed once the logger is closed
+*/
+func (l *Logger) entries() <-chan LogEntry {
+	return l.queue.entryChannel
+}
+
+/*
+Convert values that would not serialise usefully, such as source
+identifiers, into their string form
+*/
+func normaliseLogFields(keyValues []interface{}) []interface{} {
+	fields := make([]interface{}, len(keyValues))
+	for index, value := range keyValues {
+		switch typedValue := value.(type) {
+		case error:
+			fields[index] = typedValue
+		case fmt.Stringer:
+			fields[index] = typedValue.String()
+		default:
+			fields[index] = value
+		}
+	}
+	return fields
+}
+
+/*
+errorFields describes an error as log fields, including where it
+happened if it is a ReassemblyError
+*/
+func errorFields(err error) []interface{} {
+	fields := []interface{}{"error", err}
+
+	var reassemblyError *ReassemblyError
+	if errors.As(err, &reassemblyError) {
+		fields = append(fields,
+			"source", reassemblyError.SourceIdentifier.String(),
+			"session_number", reassemblyError.SessionNumber,
+			"sequence_number", reassemblyError.SequenceNumber)
+	}
+	return fields
+}
@@ -1,106 +1,159 @@
 package Routines
 
 import (
+	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
 )
 
-func HandleLogging(configJson map[string]interface{}, routineCompleteChannel chan bool, dataChannel chan map[zerolog.Level]string) {
+/*
+HandleLogging writes every message queued on the logger until the logger
+is closed. It then flushes the log file and signals completion. If the
+log file cannot be opened the error is reported on routineErrorChannel
+and messages are written to the console while the application shuts down
+*/
+func HandleLogging(loggingConfig LoggingConfig, routineHealth *RoutineHealth, routineCompleteChannel chan bool, routineErrorChannel chan<- error, logger *Logger) {
 
 	// And finally create a logger
 	var LogLevel = zerolog.DebugLevel
 	var multiWriter = zerolog.MultiLevelWriter(os.Stdout)
-	var logger = zerolog.New(multiWriter).Level(LogLevel).With().Timestamp().Logger()
-
-	// Now try update the logging level threshold
-	if LoggingConfig, exists := configJson["LoggingConfig"].(map[string]interface{}); exists {
-
-		// Logging level control
-		var strLogLevel = LoggingConfig["LoggingLevel"].(string)
-		strLogLevel = strings.ToUpper(strLogLevel)
-
-		if strLogLevel == "DEBUG" {
-			LogLevel = zerolog.DebugLevel
-		} else if strLogLevel == "INFO" {
-			LogLevel = zerolog.InfoLevel
-		} else if strLogLevel == "WARNING" {
-			LogLevel = zerolog.WarnLevel
-		} else if strLogLevel == "ERROR" {
-			LogLevel = zerolog.ErrorLevel
-		} else {
-			logger.Fatal().Msg("Error setting log level: " + strLogLevel)
-		}
-
-		// Logging output control
-		var LogToFile = false
-		var LogToConsole = false
-		var fileName = "Go_TCP_Websocket_Adapter.txt"
-
-		if strings.ToUpper(LoggingConfig["LogToFile"].(string)) == "TRUE" {
-			LogToFile = true
-		}
-		if strings.ToUpper(LoggingConfig["LogToConsole"].(string)) == "TRUE" {
+	var outputLogger = zerolog.New(multiWriter).Level(LogLevel).With().Timestamp().Logger()
+
+	// The logging level threshold is applied by the logger before queueing
+	// so that it can be changed at runtime through /admin/loglevel
+
+	// Logging output control
+	var LogToFile = bool(loggingConfig.LogToFile)
+	var LogToConsole = bool(loggingConfig.LogToConsole)
+
+	// Selectively open the log file, appending to any left by a previous run
+	var file *RotatingFileWriter
+	var err error
+	if LogToFile {
+		file, err = NewRotatingFileWriter(RotatingFileConfig{
+			Directory:        loggingConfig.LogDirectory,
+			FileNamePattern:  loggingConfig.LogFileName,
+			MaxSizeBytes:     int64(loggingConfig.MaxFileSizeMB) * 1024 * 1024,
+			MaxAge:           time.Duration(loggingConfig.MaxFileAgeHours) * time.Hour,
+			MaxRetainedFiles: int(loggingConfig.MaxRetainedFiles),
+			Compress:         bool(loggingConfig.CompressRotatedFiles),
+		})
+		if err != nil {
+			file = nil
+			LogToFile = false
 			LogToConsole = true
 		}
+	}
 
-		// Selectively create log file
-		var file *os.File
-		var err error
-		if LogToFile {
-			file, err = os.Create(fileName)
-			if err != nil {
-				logger.Fatal().Msg("Failed to create log file")
-			}
-			defer file.Close()
-		}
-
-		// Create a logger with multiple output writers
-		if LogToFile && LogToConsole {
-			multiWriter = zerolog.MultiLevelWriter(os.Stdout, file)
-		} else if LogToFile && !LogToConsole {
-			multiWriter = zerolog.MultiLevelWriter(file)
-		} else if !LogToFile && LogToConsole {
-			multiWriter = zerolog.MultiLevelWriter(os.Stdout)
-		} else {
-			logger = zerolog.New(multiWriter).With().Timestamp().Logger()
-		}
+	// Create a logger with multiple output writers
+	if LogToFile && LogToConsole {
+		multiWriter = zerolog.MultiLevelWriter(os.Stdout, file)
+	} else if LogToFile && !LogToConsole {
+		multiWriter = zerolog.MultiLevelWriter(file)
+	} else {
+		// Without any output selected we fall back to the console
+		multiWriter = zerolog.MultiLevelWriter(os.Stdout)
+	}
 
-		logger = zerolog.New(multiWriter).Level(LogLevel).With().Timestamp().Logger()
-		logger = logger.Output(multiWriter)
+	// Messages carry the time they were logged rather than when they are written
+	outputLogger = zerolog.New(multiWriter)
 
+	writeLogEntry(outputLogger, LogEntry{Level: zerolog.InfoLevel, Time: time.Now(), Message: "Starting logging routine"})
+	if err != nil {
+		routineHealth.SetRoutineState(LoggingRoutineName, RoutineFailed, err.Error())
+		routineErrorChannel <- fmt.Errorf("Logging: failed to open log file: %w", err)
 	} else {
-		logger.Fatal().Msg("Logging Config not found")
-		os.Exit(1)
-		return
+		routineHealth.SetRoutineState(LoggingRoutineName, RoutineRunning, "")
 	}
+	routineHealth.Heartbeat(LoggingRoutineName)
 
-	logger.Info().Msg("Starting logging routine")
+	// Regularly show that we are still getting through messages
+	// and report any that could not be queued
+	heartbeatTicker := time.NewTicker(LoggingHeartbeatInterval)
+	defer heartbeatTicker.Stop()
+	var reportedDroppedCount uint64
 
+	// Keep logging until every other routine has stopped
+	// and the logger has been closed and drained
 	for {
-		levelMessageMap := <-dataChannel
-
-		for logLevelKey, LogMessageString := range levelMessageMap {
-			if logLevelKey == zerolog.DebugLevel {
-				logger.Debug().Msg(LogMessageString)
-			} else if logLevelKey == zerolog.InfoLevel {
-				logger.Info().Msg(LogMessageString)
-			} else if logLevelKey == zerolog.WarnLevel {
-				logger.Warn().Msg(LogMessageString)
-			} else if logLevelKey == zerolog.ErrorLevel {
-				logger.Error().Msg(LogMessageString)
-			} else if logLevelKey == zerolog.FatalLevel {
-				logger.Fatal().Msg(LogMessageString)
+		var logEntry LogEntry
+		var channelOpen bool
+		select {
+		case logEntry, channelOpen = <-logger.entries():
+		case <-heartbeatTicker.C:
+			routineHealth.Heartbeat(LoggingRoutineName)
+			if droppedCount := logger.DroppedCount(); droppedCount > reportedDroppedCount {
+				writeLogEntry(outputLogger, LogEntry{Level: zerolog.WarnLevel, Time: time.Now(), Message: "Log buffer full, dropped messages",
+					Fields: []interface{}{"dropped_messages", droppedCount - reportedDroppedCount}})
+				reportedDroppedCount = droppedCount
 			}
+			continue
 		}
+		if !channelOpen {
+			break
+		}
+
+		writeLogEntry(outputLogger, logEntry)
+	}
+
+	writeLogEntry(outputLogger, LogEntry{Level: zerolog.InfoLevel, Time: time.Now(), Message: "Stopping logging routine"})
+	routineHealth.SetRoutineState(LoggingRoutineName, RoutineStopped, "")
+
+	// Then make sure everything reaches the disk
+	if file != nil {
+		file.Close()
 	}
 
 	routineCompleteChannel <- true
 }
 
-func CreateLogMessage(logLevel zerolog.Level, messageString string) map[zerolog.Level]string {
-	logMessage := make(map[zerolog.Level]string)
-	logMessage[logLevel] = messageString
-	return logMessage
+/*
+Write a single entry with its fields to every output
+*/
+func writeLogEntry(outputLogger zerolog.Logger, logEntry LogEntry) {
+	outputLogger.WithLevel(logEntry.Level).
+		Time(zerolog.TimestampFieldName, logEntry.Time).
+		Fields(logEntry.Fields).
+		Msg(logEntry.Message)
+}
+
+/*
+ParseLoggingLevel converts a configured level name into a zerolog level
+
+returns the level and whether the name was recognised
+*/
+func ParseLoggingLevel(strLogLevel string) (zerolog.Level, bool) {
+	switch strings.ToUpper(strLogLevel) {
+	case "DEBUG":
+		return zerolog.DebugLevel, true
+	case "INFO":
+		return zerolog.InfoLevel, true
+	case "WARNING":
+		return zerolog.WarnLevel, true
+	case "ERROR":
+		return zerolog.ErrorLevel, true
+	default:
+		return zerolog.DebugLevel, false
+	}
+}
+
+/*
+LoggingLevelName converts a zerolog level back into the name used in the configuration
+*/
+func LoggingLevelName(logLevel zerolog.Level) string {
+	switch logLevel {
+	case zerolog.DebugLevel:
+		return "Debug"
+	case zerolog.InfoLevel:
+		return "Info"
+	case zerolog.WarnLevel:
+		return "Warning"
+	case zerolog.ErrorLevel:
+		return "Error"
+	default:
+		return logLevel.String()
+	}
 }
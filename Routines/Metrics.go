@@ -0,0 +1,208 @@
+package Routines
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+///
+///			PROMETHEUS METRICS
+///
+
+const metricsNamespace = "adapter"
+
+var (
+	// Receivers
+	metricBytesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "bytes_received_total",
+		Help:      "Bytes received from sensor nodes per connection.",
+	}, []string{"connection"})
+
+	metricFramesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "frames_received_total",
+		Help:      "Complete transport layer frames received per connection.",
+	}, []string{"connection"})
+
+	metricFramesDiscarded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "frame_sync_errors_total",
+		Help:      "Times the frame decoder had to discard bytes to resynchronise, per connection.",
+	}, []string{"connection"})
+
+	metricSessionsCompleted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sessions_completed_total",
+		Help:      "Sessions reassembled into complete chunks.",
+	})
+
+	metricSessionsReset = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sessions_reset_total",
+		Help:      "Partial sessions dropped before completing, by reason.",
+	}, []string{"reason"})
+
+	// Routing
+	metricJSONUnmarshalFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "json_unmarshal_failures_total",
+		Help:      "Chunks whose JSON could not be unmarshalled by the routing routine.",
+	})
+
+	metricUnregisteredChunks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "unregistered_chunks_total",
+		Help:      "Chunks dropped because their chunk type is not registered, by chunk type.",
+	}, []string{"chunk_type"})
+
+	metricChunkTypeMismatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "chunk_type_mismatches_total",
+		Help:      "Chunks whose JSON root key differs from the chunk type configured or learnt for their identifier, by that chunk type and root key.",
+	}, []string{"chunk_type", "root_key"})
+
+	// WebSocket clients
+	metricWebSocketMessagesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "websocket_messages_sent_total",
+		Help:      "Messages written to WebSocket clients, by chunk type.",
+	}, []string{"chunk_type"})
+
+	metricWebSocketConnectionsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "websocket_connections_rejected_total",
+		Help:      "WebSocket connections refused before the upgrade, by reason.",
+	}, []string{"reason"})
+
+	metricWebSocketDisconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "websocket_disconnects_total",
+		Help:      "WebSocket clients disconnected, by reason.",
+	}, []string{"reason"})
+
+	metricWebSocketMessagesDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "websocket_messages_dropped_total",
+		Help:      "Messages not delivered to WebSocket clients, by chunk type and reason.",
+	}, []string{"chunk_type", "reason"})
+
+	// Recorder
+	metricRecorderChunksWritten = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "recorder_chunks_written_total",
+		Help:      "Chunks written to the recording.",
+	})
+
+	metricRecorderChunksDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "recorder_chunks_dropped_total",
+		Help:      "Chunks not written to the recording, by reason.",
+	}, []string{"reason"})
+
+	// Logging
+	metricLogMessagesDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "log_messages_dropped_total",
+		Help:      "Log messages dropped because the logging buffer was full.",
+	})
+)
+
+// Reasons a session may be reset
+const (
+	sessionResetSequenceGap = "sequence_gap"
+	sessionResetTooShort    = "first_transmission_too_short"
+	sessionResetStale       = "stale"
+)
+
+// Reasons a chunk may not be recorded
+const (
+	recorderDropBufferFull = "buffer_full"
+	recorderDropWriteError = "write_error"
+)
+
+// Reasons a message may not reach a WebSocket client
+const (
+	messageDropRateLimit     = "rate_limit"
+	messageDropBufferFull    = "buffer_full"
+	messageDropEncodingError = "encoding_error"
+)
+
+// Reasons a WebSocket connection may be refused
+const (
+	rejectOriginNotAllowed      = "origin_not_allowed"
+	rejectAccessTokenMissing    = "access_token_missing"
+	rejectAccessTokenInvalid    = "access_token_invalid"
+	rejectChunkTypeNotPermitted = "chunk_type_not_permitted"
+)
+
+/*
+Remove the per connection series once a connection closes so that
+short lived connections do not accumulate
+*/
+func forgetConnectionMetrics(connection string) {
+	metricBytesReceived.DeleteLabelValues(connection)
+	metricFramesReceived.DeleteLabelValues(connection)
+	metricFramesDiscarded.DeleteLabelValues(connection)
+}
+
+/*
+Record the outcome of adding a transmission to a session reassembler
+*/
+func recordReassemblyResult(chunkComplete bool, err error) {
+	if err == nil {
+		if chunkComplete {
+			metricSessionsCompleted.Inc()
+		}
+		return
+	}
+
+	reassemblyError, isReassemblyError := err.(*ReassemblyError)
+	if !isReassemblyError {
+		return
+	}
+	switch reassemblyError.Err {
+	case ErrSequenceGap:
+		metricSessionsReset.WithLabelValues(sessionResetSequenceGap).Inc()
+	case ErrFirstFrameTooShort:
+		metricSessionsReset.WithLabelValues(sessionResetTooShort).Inc()
+	}
+}
+
+/*
+hubCollector reports the number of connected WebSocket clients and the
+number of chunks waiting in their buffers for each chunk type
+*/
+type hubCollector struct {
+	chunkTypeHub     *ChunkBroadcastHub
+	clientsDesc      *prometheus.Desc
+	channelDepthDesc *prometheus.Desc
+}
+
+func newHubCollector(chunkTypeHub *ChunkBroadcastHub) *hubCollector {
+	return &hubCollector{
+		chunkTypeHub: chunkTypeHub,
+		clientsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "websocket_clients"),
+			"WebSocket clients currently connected, by chunk type.",
+			[]string{"chunk_type"}, nil),
+		channelDepthDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "chunk_channel_depth"),
+			"Chunks waiting in WebSocket client buffers, by chunk type.",
+			[]string{"chunk_type"}, nil),
+	}
+}
+
+func (c *hubCollector) Describe(descChannel chan<- *prometheus.Desc) {
+	descChannel <- c.clientsDesc
+	descChannel <- c.channelDepthDesc
+}
+
+func (c *hubCollector) Collect(metricChannel chan<- prometheus.Metric) {
+	for _, chunkTypeStatistics := range c.chunkTypeHub.Statistics() {
+		metricChannel <- prometheus.MustNewConstMetric(c.clientsDesc, prometheus.GaugeValue,
+			float64(chunkTypeStatistics.SubscriberCount), chunkTypeStatistics.ChunkType)
+		metricChannel <- prometheus.MustNewConstMetric(c.channelDepthDesc, prometheus.GaugeValue,
+			float64(chunkTypeStatistics.BufferedChunks), chunkTypeStatistics.ChunkType)
+	}
+}
@@ -0,0 +1,212 @@
+package Routines
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+///
+///			WEBSOCKET RATE LIMITING
+///
+
+// Query parameter clients lower their message rate with
+const rateQueryParameter = "rate"
+
+// How often clients are told how many messages were dropped, at most
+const rateLimitStatusInterval = time.Second
+
+/*
+TokenBucket allows events at a steady rate with bursts of up to its
+capacity. A rate of 0 allows every event
+*/
+type TokenBucket struct {
+	rate       float64   // Tokens added per second
+	capacity   float64   // Most tokens held at once
+	tokens     float64   // Tokens currently held
+	lastRefill time.Time // When tokens were last added
+}
+
+func NewTokenBucket(rate float64, capacity int) *TokenBucket {
+	bucket := new(TokenBucket)
+	bucket.rate = rate
+	bucket.capacity = float64(capacity)
+	bucket.tokens = bucket.capacity
+	bucket.lastRefill = time.Now()
+	return bucket
+}
+
+/*
+Take a token if one is available
+*/
+func (b *TokenBucket) Take(now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+/*
+How long until a token is available
+*/
+func (b *TokenBucket) Wait(now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.lastRefill); elapsed > 0 {
+		b.tokens = math.Min(b.capacity, b.tokens+elapsed.Seconds()*b.rate)
+		b.lastRefill = now
+	}
+}
+
+/*
+LatestWinsRateLimiter limits the chunks sent to a client without losing
+the most recent one. A chunk arriving too soon is held until a token is
+available, and a newer chunk arriving in the meantime replaces it, so
+the client always ends up with the newest chunk
+*/
+type LatestWinsRateLimiter struct {
+	bucket          *TokenBucket
+	pendingChunk    *Chunk      // Chunk waiting for a token
+	pendingTimer    *time.Timer // Fires once the pending chunk may be sent
+	droppedMessages uint64      // Chunks replaced before they were sent
+}
+
+func NewLatestWinsRateLimiter(messagesPerSecond float64) *LatestWinsRateLimiter {
+	rateLimiter := new(LatestWinsRateLimiter)
+	rateLimiter.bucket = NewTokenBucket(messagesPerSecond, 1)
+	return rateLimiter
+}
+
+/*
+Offer a chunk to the limiter
+
+returns the chunk if it may be sent now, otherwise it is held and sent
+once Ready fires unless a newer chunk replaces it
+*/
+func (l *LatestWinsRateLimiter) Offer(chunk Chunk, now time.Time) (Chunk, bool) {
+	if l.pendingChunk != nil {
+		l.pendingChunk = &chunk
+		l.droppedMessages++
+		return Chunk{}, false
+	}
+
+	if l.bucket.Take(now) {
+		return chunk, true
+	}
+	l.pendingChunk = &chunk
+	l.pendingTimer = time.NewTimer(l.bucket.Wait(now))
+	return Chunk{}, false
+}
+
+/*
+Ready fires when the held chunk may be sent, and is nil while no chunk is held
+*/
+func (l *LatestWinsRateLimiter) Ready() <-chan time.Time {
+	if l.pendingTimer == nil {
+		return nil
+	}
+	return l.pendingTimer.C
+}
+
+/*
+TakePending returns the held chunk once Ready has fired
+*/
+func (l *LatestWinsRateLimiter) TakePending(now time.Time) (Chunk, bool) {
+	if l.pendingChunk == nil {
+		return Chunk{}, false
+	}
+
+	// Timers may fire a little early
+	if !l.bucket.Take(now) {
+		l.pendingTimer = time.NewTimer(l.bucket.Wait(now))
+		return Chunk{}, false
+	}
+	chunk := *l.pendingChunk
+	l.pendingChunk = nil
+	l.pendingTimer = nil
+	return chunk, true
+}
+
+/*
+Number of chunks replaced by newer chunks before they could be sent
+*/
+func (l *LatestWinsRateLimiter) DroppedMessages() uint64 {
+	return l.droppedMessages
+}
+
+/*
+Stop releases the timer of any held chunk
+*/
+func (l *LatestWinsRateLimiter) Stop() {
+	if l.pendingTimer != nil {
+		l.pendingTimer.Stop()
+	}
+}
+
+/*
+RateLimitStatus is sent to rate limited clients as a text message
+{"RateLimitStatus": {...}} whenever more messages have been dropped
+*/
+type RateLimitStatus struct {
+	ChunkType            string  `json:",omitempty"` // Chunk type limited, given on /stream only
+	MaxMessagesPerSecond float64 // Rate the client is limited to
+	DroppedMessages      uint64  // Messages dropped since the client connected
+}
+
+func (s RateLimitStatus) MarshalMessage() ([]byte, error) {
+	return json.Marshal(map[string]RateLimitStatus{"RateLimitStatus": s})
+}
+
+/*
+The messages per second a client of a chunk type is limited to, 0 for
+no limit. Clients may ask for a lower rate than configured but not a
+higher one, with 0 asking for the configured rate
+*/
+func clientMessageRate(webSocketTxConfig WebSocketTxConfig, chunkType string, requestedRate float64) float64 {
+	configuredRate := float64(webSocketTxConfig.DefaultMaxMessagesPerSecond)
+	if chunkTypeRate, exists := webSocketTxConfig.MaxMessagesPerSecond[chunkType]; exists {
+		configuredRate = float64(chunkTypeRate)
+	}
+
+	if requestedRate == 0 || (configuredRate > 0 && requestedRate > configuredRate) {
+		return configuredRate
+	}
+	return requestedRate
+}
+
+/*
+Parse the rate a client asked for in the query, empty meaning 0
+*/
+func parseRequestedRate(requestedRate string) (float64, error) {
+	if requestedRate == "" {
+		return 0, nil
+	}
+
+	rate, err := strconv.ParseFloat(requestedRate, 64)
+	if err != nil || !validRequestedRate(rate) {
+		return 0, errors.New("rate must be a number of messages per second, got " + strconv.Quote(requestedRate))
+	}
+	return rate, nil
+}
+
+func validRequestedRate(rate float64) bool {
+	return rate >= 0 && !math.IsInf(rate, 0) && !math.IsNaN(rate)
+}
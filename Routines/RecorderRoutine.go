@@ -0,0 +1,112 @@
+package Routines
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+const RecorderRoutineName = "Recorder"
+
+/*
+ChunkRecord is a single line of a recording
+*/
+type ChunkRecord struct {
+	ArrivalTime         time.Time // When the last byte of the chunk arrived
+	ChunkType           string    // Chunk type name
+	ChunkTypeIdentifier uint32    // Numeric chunk type from the session header
+	SourceIdentifier    string    // Identifier of the producing device
+	SessionNumber       uint32    // Session the chunk was transmitted in
+	JSONData            string    // The chunk serialised as JSON
+}
+
+func NewChunkRecord(chunk Chunk) ChunkRecord {
+	return ChunkRecord{
+		ArrivalTime:         chunk.ArrivalTime,
+		ChunkType:           chunk.ChunkType,
+		ChunkTypeIdentifier: chunk.ChunkTypeIdentifier,
+		SourceIdentifier:    chunk.SourceIdentifier.String(),
+		SessionNumber:       chunk.SessionNumber,
+		JSONData:            chunk.JSONData,
+	}
+}
+
+/*
+HandleChunkRecording writes every chunk received on the data channel as
+one line of newline delimited JSON, starting a new file as configured.
+Chunks already queued are written before returning on shutdown
+*/
+func HandleChunkRecording(ctx context.Context, recorderConfig RecorderConfig, routineHealth *RoutineHealth, logger *Logger, dataChannel <-chan Chunk) error {
+
+	recordingFile, err := NewRotatingFileWriter(RotatingFileConfig{
+		Directory:        recorderConfig.Directory,
+		FileNamePattern:  recorderConfig.FileName,
+		MaxSizeBytes:     int64(recorderConfig.MaxFileSizeMB) * 1024 * 1024,
+		MaxAge:           time.Duration(recorderConfig.MaxFileAgeHours) * time.Hour,
+		MaxRetainedFiles: int(recorderConfig.MaxRetainedFiles),
+		Compress:         bool(recorderConfig.CompressRotatedFiles),
+	})
+	if err != nil {
+		return err
+	}
+	defer recordingFile.Close()
+
+	logger.Info("Recording chunks", "file", recordingFile.FilePath())
+	routineHealth.SetRoutineState(RecorderRoutineName, RoutineRunning, "Recording to "+recorderConfig.Directory)
+
+	for {
+		var chunk Chunk
+		select {
+		case chunk = <-dataChannel:
+		case <-ctx.Done():
+			// Write what was queued before we were asked to stop
+			for {
+				select {
+				case chunk = <-dataChannel:
+					writeChunkRecord(recordingFile, logger, chunk)
+				default:
+					logger.Info("Stopped recording chunks", "file", recordingFile.FilePath())
+					routineHealth.SetRoutineState(RecorderRoutineName, RoutineStopped, "")
+					return nil
+				}
+			}
+		}
+
+		writeChunkRecord(recordingFile, logger, chunk)
+	}
+}
+
+/*
+Write one chunk as a line of the recording. Each line is written in a
+single call so that it is never split across files
+*/
+func writeChunkRecord(recordingFile *RotatingFileWriter, logger *Logger, chunk Chunk) {
+	recordLine, err := json.Marshal(NewChunkRecord(chunk))
+	if err != nil {
+		logger.Error("Error marshaling chunk record", "error", err, "chunk_type", chunk.ChunkType)
+		return
+	}
+
+	if _, err := recordingFile.Write(append(recordLine, '\n')); err != nil {
+		metricRecorderChunksDropped.WithLabelValues(recorderDropWriteError).Inc()
+		logger.Error("Error writing chunk record", "error", err, "file", recordingFile.FilePath())
+		return
+	}
+	metricRecorderChunksWritten.Inc()
+}
+
+/*
+Queue a chunk for the recorder without holding up routing. Chunks are
+dropped if the recorder has fallen behind
+*/
+func queueChunkRecord(recordChannel chan<- Chunk, chunk Chunk) {
+	if recordChannel == nil {
+		return
+	}
+
+	select {
+	case recordChannel <- chunk:
+	default:
+		metricRecorderChunksDropped.WithLabelValues(recorderDropBufferFull).Inc()
+	}
+}
@@ -0,0 +1,172 @@
+package Routines
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const ReplayRoutineName = "Replay"
+
+// Longest line of a recording that can be replayed
+const maxChunkRecordBytes = 64 * 1024 * 1024
+
+/*
+ReplayOptions controls how a recording is fed back through the adapter
+*/
+type ReplayOptions struct {
+	FilePath   string        // Recording to replay, gzipped if it ends in .gz
+	Speed      float64       // Multiplier applied to the recorded timing, 2 plays twice as fast
+	Loop       bool          // Start again from the seek offset once the recording ends
+	SeekOffset time.Duration // Skip chunks that arrived within this long of the first
+}
+
+/*
+HandleChunkReplay reads a recording written by the recorder and sends
+each chunk on the data channel, waiting between chunks for as long as
+they originally took to arrive divided by the replay speed
+*/
+func HandleChunkReplay(ctx context.Context, replayOptions ReplayOptions, routineHealth *RoutineHealth, logger *Logger, dataChannel chan<- Chunk) error {
+
+	if replayOptions.Speed <= 0 {
+		return errors.New("replay speed must be greater than 0")
+	}
+
+	logger.Info("Replaying recording", "file", replayOptions.FilePath, "speed", replayOptions.Speed,
+		"loop", replayOptions.Loop, "seek_offset", replayOptions.SeekOffset.String())
+	routineHealth.SetRoutineState(ReplayRoutineName, RoutineRunning, "Replaying "+replayOptions.FilePath)
+
+	for {
+		chunksReplayed, err := replayRecording(ctx, replayOptions, logger, dataChannel)
+		if ctx.Err() != nil {
+			logger.Info("Stopped replaying recording", "file", replayOptions.FilePath)
+			routineHealth.SetRoutineState(ReplayRoutineName, RoutineStopped, "")
+			return nil
+		} else if err != nil {
+			return err
+		} else if chunksReplayed == 0 {
+			return errors.New("recording " + replayOptions.FilePath + " holds no chunks after the seek offset")
+		}
+
+		logger.Info("Finished replaying recording", "file", replayOptions.FilePath, "chunks_replayed", chunksReplayed)
+		if !replayOptions.Loop {
+			routineHealth.SetRoutineState(ReplayRoutineName, RoutineStopped, "Finished replaying "+replayOptions.FilePath)
+			return nil
+		}
+	}
+}
+
+/*
+Replay the recording once from the seek offset
+
+returns the number of chunks sent
+*/
+func replayRecording(ctx context.Context, replayOptions ReplayOptions, logger *Logger, dataChannel chan<- Chunk) (int, error) {
+
+	recordReader, err := openRecording(replayOptions.FilePath)
+	if err != nil {
+		return 0, err
+	}
+	defer recordReader.Close()
+
+	scanner := bufio.NewScanner(recordReader)
+	scanner.Buffer(make([]byte, 64*1024), maxChunkRecordBytes)
+
+	// Recorded times are measured from the seek offset
+	// and wall clock times from when the replay started
+	var replayStartTime time.Time
+	var recordingStartTime time.Time
+	chunksReplayed := 0
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+
+		var chunkRecord ChunkRecord
+		if err := json.Unmarshal(scanner.Bytes(), &chunkRecord); err != nil {
+			logger.Warn("Skipping unreadable chunk record", "file", replayOptions.FilePath, "line", lineNumber, "error", err)
+			continue
+		}
+		sourceIdentifier, err := ParseSourceIdentifier(chunkRecord.SourceIdentifier)
+		if err != nil {
+			logger.Warn("Skipping unreadable chunk record", "file", replayOptions.FilePath, "line", lineNumber, "error", err)
+			continue
+		}
+
+		if recordingStartTime.IsZero() {
+			recordingStartTime = chunkRecord.ArrivalTime.Add(replayOptions.SeekOffset)
+			replayStartTime = time.Now()
+		}
+		recordingOffset := chunkRecord.ArrivalTime.Sub(recordingStartTime)
+		if recordingOffset < 0 {
+			continue
+		}
+
+		// Wait until the chunk is due
+		replayOffset := time.Duration(float64(recordingOffset) / replayOptions.Speed)
+		if waitTime := time.Until(replayStartTime.Add(replayOffset)); waitTime > 0 {
+			waitTimer := time.NewTimer(waitTime)
+			select {
+			case <-waitTimer.C:
+			case <-ctx.Done():
+				waitTimer.Stop()
+				return chunksReplayed, ctx.Err()
+			}
+		}
+
+		// Replayed chunks arrive now as far as the rest of the adapter is concerned
+		chunk := Chunk{
+			ChunkTypeIdentifier: chunkRecord.ChunkTypeIdentifier,
+			SourceIdentifier:    sourceIdentifier,
+			SessionNumber:       chunkRecord.SessionNumber,
+			ArrivalTime:         time.Now(),
+			JSONData:            chunkRecord.JSONData,
+		}
+		select {
+		case dataChannel <- chunk:
+		case <-ctx.Done():
+			return chunksReplayed, ctx.Err()
+		}
+		chunksReplayed++
+	}
+
+	return chunksReplayed, scanner.Err()
+}
+
+/*
+Open a recording, decompressing it if it was gzipped
+*/
+func openRecording(filePath string) (io.ReadCloser, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(filePath, ".gz") {
+		return file, nil
+	}
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &gzipRecordingReader{Reader: gzipReader, file: file}, nil
+}
+
+/*
+Closes both the decompressor and the file beneath it
+*/
+type gzipRecordingReader struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (r *gzipRecordingReader) Close() error {
+	return errors.Join(r.Reader.Close(), r.file.Close())
+}
@@ -0,0 +1,347 @@
+package Routines
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+///
+///			ROTATING FILE WRITER
+///
+
+/*
+Placeholder in a file name pattern that is replaced by the time the file was opened
+*/
+const FileNameTimestampPlaceholder = "{timestamp}"
+
+// File system safe layout used for timestamps in file names
+const fileNameTimestampLayout = "20060102T150405"
+
+// Opens files for writing, replaced in tests to simulate failures
+var openRotatingFile = os.OpenFile
+
+/*
+RotatingFileConfig controls where a RotatingFileWriter writes and when it
+starts a new file
+*/
+type RotatingFileConfig struct {
+	Directory        string        // Directory files are written to, created if missing
+	FileNamePattern  string        // File name, optionally holding FileNameTimestampPlaceholder
+	MaxSizeBytes     int64         // Start a new file before exceeding this size, 0 for no limit
+	MaxAge           time.Duration // Start a new file once it has been open this long, 0 for no limit
+	MaxRetainedFiles int           // Rotated files kept before the oldest are deleted, 0 to keep all
+	Compress         bool          // Gzip files once they have been rotated
+}
+
+/*
+RotatingFileWriter appends to a file, moving on to a new file once the
+current one is too large or too old. Rotated files are optionally
+compressed and the oldest deleted in the background so that writes are
+not held up. A file name pattern without FileNameTimestampPlaceholder
+always writes to the same path, with rotated files renamed to include
+the time they were rotated. A rotation that fails keeps writing to the
+current file, or opens a file again on the next write, so one failure
+does not stop the writer
+*/
+type RotatingFileWriter struct {
+	mu                  sync.Mutex // Mutex to protect the current file
+	config              RotatingFileConfig
+	file                *os.File       // File currently written to, nil if it could not be opened
+	closed              bool           // Whether Close has been called
+	filePath            string         // Path of the current file
+	fileSize            int64          // Bytes in the current file
+	openedAt            time.Time      // When the current file was opened
+	housekeepingMutex   sync.Mutex     // Only one rotated file is compressed or pruned at a time
+	housekeepingWaiting sync.WaitGroup // Compression and pruning not yet finished
+}
+
+/*
+Create a writer and open its first file, appending if it already exists
+*/
+func NewRotatingFileWriter(config RotatingFileConfig) (*RotatingFileWriter, error) {
+	if err := os.MkdirAll(config.Directory, 0o755); err != nil {
+		return nil, err
+	}
+
+	writer := new(RotatingFileWriter)
+	writer.config = config
+	if err := writer.openFile(time.Now()); err != nil {
+		return nil, err
+	}
+
+	// Tidy up after previous runs
+	writer.pruneRotatedFiles()
+
+	return writer, nil
+}
+
+/*
+Write appends to the current file, first rotating it if the bytes would
+take it over the size limit or it has been open longer than the age limit
+*/
+func (w *RotatingFileWriter) Write(byteArray []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+
+	// A previous rotation may have failed to open the next file
+	now := time.Now()
+	if w.file == nil {
+		if err := w.openFile(now); err != nil {
+			return 0, err
+		}
+	}
+
+	tooLarge := w.config.MaxSizeBytes > 0 && w.fileSize > 0 && w.fileSize+int64(len(byteArray)) > w.config.MaxSizeBytes
+	tooOld := w.config.MaxAge > 0 && now.Sub(w.openedAt) >= w.config.MaxAge
+	if tooLarge || tooOld {
+		// The bytes still go to whichever file is open, and a failed
+		// rotation is attempted again on a later write
+		if err := w.rotate(now); err != nil && w.file == nil {
+			return 0, err
+		}
+	}
+
+	bytesWritten, err := w.file.Write(byteArray)
+	w.fileSize += int64(bytesWritten)
+	return bytesWritten, err
+}
+
+/*
+Rotate closes the current file and starts a new one
+*/
+func (w *RotatingFileWriter) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return os.ErrClosed
+	}
+	if w.file == nil {
+		return w.openFile(time.Now())
+	}
+	return w.rotate(time.Now())
+}
+
+/*
+Sync flushes the current file to disk
+*/
+func (w *RotatingFileWriter) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return os.ErrClosed
+	}
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Sync()
+}
+
+/*
+Close flushes and closes the current file and waits for any rotated
+files to finish being compressed
+*/
+func (w *RotatingFileWriter) Close() error {
+	w.mu.Lock()
+	var err error
+	if w.file != nil {
+		err = errors.Join(w.file.Sync(), w.file.Close())
+		w.file = nil
+	}
+	w.closed = true
+	w.mu.Unlock()
+
+	w.housekeepingWaiting.Wait()
+	return err
+}
+
+/*
+Path of the file currently being written to
+*/
+func (w *RotatingFileWriter) FilePath() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.filePath
+}
+
+/*
+Close the current file and open the next. If the current file cannot be
+moved aside it is opened again, and if the next file cannot be opened
+the file is left nil for the next write to open
+*/
+func (w *RotatingFileWriter) rotate(now time.Time) error {
+
+	// The file is released even when closing reports an error
+	closeError := w.file.Close()
+	w.file = nil
+
+	// Files always written to the same path are moved aside
+	rotatedPath := w.filePath
+	if !strings.Contains(w.config.FileNamePattern, FileNameTimestampPlaceholder) {
+		rotatedFileName := strings.Replace(w.rotatedFilePattern(), FileNameTimestampPlaceholder, now.Format(fileNameTimestampLayout), 1)
+		rotatedPath = uniqueFilePath(filepath.Join(w.config.Directory, rotatedFileName))
+		if err := os.Rename(w.filePath, rotatedPath); err != nil {
+			// Reopening the same path carries on appending to it
+			return errors.Join(closeError, err, w.openFile(now))
+		}
+	}
+
+	if err := w.openFile(now); err != nil {
+		return errors.Join(closeError, err)
+	}
+
+	// Compress and prune without holding up writes
+	w.housekeepingWaiting.Add(1)
+	go func() {
+		defer w.housekeepingWaiting.Done()
+		w.housekeepingMutex.Lock()
+		defer w.housekeepingMutex.Unlock()
+
+		if w.config.Compress {
+			compressFile(rotatedPath)
+		}
+		w.pruneRotatedFiles()
+	}()
+
+	return closeError
+}
+
+func (w *RotatingFileWriter) openFile(now time.Time) error {
+	filePath := filepath.Join(w.config.Directory,
+		strings.Replace(w.config.FileNamePattern, FileNameTimestampPlaceholder, now.Format(fileNameTimestampLayout), 1))
+	if strings.Contains(w.config.FileNamePattern, FileNameTimestampPlaceholder) && w.filePath != "" {
+		// Rotating twice within a second would otherwise reopen a rotated file
+		filePath = uniqueFilePath(filePath)
+	}
+
+	file, err := openRotatingFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.filePath = filePath
+	w.fileSize = fileInfo.Size()
+	w.openedAt = now
+	return nil
+}
+
+/*
+Pattern rotated files are named by. Patterns without a timestamp
+placeholder have one added before the extension
+*/
+func (w *RotatingFileWriter) rotatedFilePattern() string {
+	if strings.Contains(w.config.FileNamePattern, FileNameTimestampPlaceholder) {
+		return w.config.FileNamePattern
+	}
+	extension := filepath.Ext(w.config.FileNamePattern)
+	baseName := strings.TrimSuffix(w.config.FileNamePattern, extension)
+	return baseName + "-" + FileNameTimestampPlaceholder + extension
+}
+
+/*
+Delete the oldest rotated files beyond the retention limit
+*/
+func (w *RotatingFileWriter) pruneRotatedFiles() {
+	if w.config.MaxRetainedFiles <= 0 {
+		return
+	}
+
+	// Rotated files are found by replacing the timestamp with a wildcard
+	globPattern := filepath.Join(w.config.Directory, strings.Replace(w.rotatedFilePattern(), FileNameTimestampPlaceholder, "*", 1))
+	currentFilePath := w.FilePath()
+
+	type rotatedFile struct {
+		path    string
+		modTime time.Time
+	}
+	var rotatedFiles []rotatedFile
+	for _, pattern := range []string{globPattern, globPattern + ".gz"} {
+		matches, _ := filepath.Glob(pattern)
+		for _, match := range matches {
+			if match == currentFilePath {
+				continue
+			}
+			if fileInfo, err := os.Stat(match); err == nil && fileInfo.Mode().IsRegular() {
+				rotatedFiles = append(rotatedFiles, rotatedFile{path: match, modTime: fileInfo.ModTime()})
+			}
+		}
+	}
+
+	// Newest first so that everything past the limit is removed
+	sort.Slice(rotatedFiles, func(i, j int) bool {
+		return rotatedFiles[i].modTime.After(rotatedFiles[j].modTime)
+	})
+	for index := w.config.MaxRetainedFiles; index < len(rotatedFiles); index++ {
+		os.Remove(rotatedFiles[index].path)
+	}
+}
+
+/*
+Gzip a file alongside itself and remove the original once complete
+*/
+func compressFile(filePath string) error {
+	sourceFile, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	compressedFile, err := os.OpenFile(filePath+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	gzipWriter := gzip.NewWriter(compressedFile)
+	_, err = io.Copy(gzipWriter, sourceFile)
+	err = errors.Join(err, gzipWriter.Close(), compressedFile.Close())
+	if err != nil {
+		os.Remove(filePath + ".gz")
+		return err
+	}
+
+	sourceFile.Close()
+	return os.Remove(filePath)
+}
+
+/*
+Add a numeric suffix to a path until neither it nor its compressed
+form names an existing file
+*/
+func uniqueFilePath(filePath string) string {
+	if !fileExists(filePath) && !fileExists(filePath+".gz") {
+		return filePath
+	}
+
+	extension := filepath.Ext(filePath)
+	basePath := strings.TrimSuffix(filePath, extension)
+	for suffix := 1; ; suffix++ {
+		candidatePath := basePath + "-" + strconv.Itoa(suffix) + extension
+		if !fileExists(candidatePath) && !fileExists(candidatePath+".gz") {
+			return candidatePath
+		}
+	}
+}
+
+func fileExists(filePath string) bool {
+	_, err := os.Stat(filePath)
+	return !errors.Is(err, os.ErrNotExist)
+}
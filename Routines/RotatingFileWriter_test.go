@@ -0,0 +1,124 @@
+package Routines
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var errTestOpenFailed = errors.New("open failed")
+
+/*
+Make the next opens of rotating files fail, as many times as failures
+*/
+func failRotatingFileOpens(t *testing.T, failures int) {
+	t.Helper()
+
+	t.Cleanup(func() { openRotatingFile = os.OpenFile })
+	openRotatingFile = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		if failures > 0 {
+			failures--
+			return nil, errTestOpenFailed
+		}
+		return os.OpenFile(name, flag, perm)
+	}
+}
+
+func readTestFile(t *testing.T, filePath string) string {
+	t.Helper()
+
+	byteArray, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(byteArray)
+}
+
+func writeTestLine(t *testing.T, writer *RotatingFileWriter, line string) {
+	t.Helper()
+
+	if _, err := writer.Write([]byte(line)); err != nil {
+		t.Fatalf("writing %q: %v", line, err)
+	}
+}
+
+func TestRotatingFileWriterSizeLimit(t *testing.T) {
+	directory := t.TempDir()
+	writer, err := NewRotatingFileWriter(RotatingFileConfig{Directory: directory, FileNamePattern: "test.log", MaxSizeBytes: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	writeTestLine(t, writer, "first\n")
+	writeTestLine(t, writer, "second\n")
+
+	if contents := readTestFile(t, filepath.Join(directory, "test.log")); contents != "second\n" {
+		t.Errorf("current file holds %q, want %q", contents, "second\n")
+	}
+	rotatedFiles, _ := filepath.Glob(filepath.Join(directory, "test-*.log"))
+	if len(rotatedFiles) != 1 || readTestFile(t, rotatedFiles[0]) != "first\n" {
+		t.Errorf("rotated files are %v, want one holding %q", rotatedFiles, "first\n")
+	}
+}
+
+func TestRotatingFileWriterFailedOpen(t *testing.T) {
+	directory := t.TempDir()
+	writer, err := NewRotatingFileWriter(RotatingFileConfig{Directory: directory, FileNamePattern: "test.log", MaxSizeBytes: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	writeTestLine(t, writer, "first\n")
+
+	// The rotation moves the file aside but cannot open the next
+	failRotatingFileOpens(t, 1)
+	if _, err := writer.Write([]byte("lost\n")); !errors.Is(err, errTestOpenFailed) {
+		t.Fatalf("Write returned %v, want the open error", err)
+	}
+
+	// So the next write opens it
+	writeTestLine(t, writer, "second\n")
+	if err := writer.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if contents := readTestFile(t, filepath.Join(directory, "test.log")); contents != "second\n" {
+		t.Errorf("current file holds %q, want %q", contents, "second\n")
+	}
+}
+
+func TestRotatingFileWriterFailedRename(t *testing.T) {
+	directory := t.TempDir()
+	writer, err := NewRotatingFileWriter(RotatingFileConfig{Directory: directory, FileNamePattern: "test.log", MaxSizeBytes: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	writeTestLine(t, writer, "first\n")
+
+	// Removing the current file makes moving it aside fail,
+	// after which the same path is opened again
+	if err := os.Remove(filepath.Join(directory, "test.log")); err != nil {
+		t.Fatal(err)
+	}
+	writeTestLine(t, writer, "second\n")
+
+	if contents := readTestFile(t, filepath.Join(directory, "test.log")); contents != "second\n" {
+		t.Errorf("current file holds %q, want %q", contents, "second\n")
+	}
+}
+
+func TestRotatingFileWriterClosed(t *testing.T) {
+	writer, err := NewRotatingFileWriter(RotatingFileConfig{Directory: t.TempDir(), FileNamePattern: "test.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := writer.Write([]byte("late\n")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Write returned %v, want os.ErrClosed", err)
+	}
+}
@@ -0,0 +1,176 @@
+package Routines
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+SourceIdentifier identifies the device that produced a chunk, typically
+its MAC address
+*/
+type SourceIdentifier [6]byte
+
+/*
+String formats the identifier as a colon separated MAC address
+*/
+func (s SourceIdentifier) String() string {
+	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", s[0], s[1], s[2], s[3], s[4], s[5])
+}
+
+/*
+ParseSourceIdentifier reads an identifier in the form written by String
+*/
+func ParseSourceIdentifier(identifierString string) (SourceIdentifier, error) {
+	var sourceIdentifier SourceIdentifier
+
+	hardwareAddress, err := net.ParseMAC(identifierString)
+	if err != nil {
+		return sourceIdentifier, err
+	}
+	if len(hardwareAddress) != len(sourceIdentifier) {
+		return sourceIdentifier, fmt.Errorf("source identifier %q is not %d bytes", identifierString, len(sourceIdentifier))
+	}
+
+	copy(sourceIdentifier[:], hardwareAddress)
+	return sourceIdentifier, nil
+}
+
+/*
+SessionHeader is the 23 byte header at the start of every session layer
+transmission (v1.0.0 of chunk types). All fields are little endian
+
+	|State(1)|Session(4)|Sequence(4)|ChunkType(4)|Source(6)|Trailing(4)|
+*/
+type SessionHeader struct {
+	TransmissionState byte             // 1 if this is the last transmission in the session
+	SessionNumber     uint32           // Incremented by the producer for each chunk
+	SequenceNumber    uint32           // Position of this transmission within the session
+	ChunkType         uint32           // Numeric identifier of the chunk type
+	SourceIdentifier  SourceIdentifier // Identifier of the producing device
+	TrailingBytes     [4]byte          // Remaining header bytes which are not yet interpreted
+}
+
+/*
+ParseSessionHeader extracts every field of a session header. The byte
+array must hold at least SessionLayerHeaderSize bytes
+*/
+func ParseSessionHeader(byteArray []byte) SessionHeader {
+
+	var sessionHeader SessionHeader
+	index := 0
+
+	// Lets first start by extracting the whether this is the finals sequence in session
+	sessionHeader.TransmissionState = byteArray[index]
+	index += 1
+
+	// Then we extract session number
+	sessionHeader.SessionNumber = binary.LittleEndian.Uint32(byteArray[index : index+4])
+	index += 4
+
+	// And sequence number
+	sessionHeader.SequenceNumber = binary.LittleEndian.Uint32(byteArray[index : index+4])
+	index += 4
+
+	// Then the chunk type
+	sessionHeader.ChunkType = binary.LittleEndian.Uint32(byteArray[index : index+4])
+	index += 4
+
+	// And source identifier
+	copy(sessionHeader.SourceIdentifier[:], byteArray[index:index+6])
+	index += 6
+
+	copy(sessionHeader.TrailingBytes[:], byteArray[index:index+4])
+
+	return sessionHeader
+}
+
+/*
+AppendSessionHeader appends the 23 byte encoding of a session header,
+the reverse of ParseSessionHeader
+*/
+func AppendSessionHeader(byteArray []byte, sessionHeader SessionHeader) []byte {
+	byteArray = append(byteArray, sessionHeader.TransmissionState)
+	byteArray = binary.LittleEndian.AppendUint32(byteArray, sessionHeader.SessionNumber)
+	byteArray = binary.LittleEndian.AppendUint32(byteArray, sessionHeader.SequenceNumber)
+	byteArray = binary.LittleEndian.AppendUint32(byteArray, sessionHeader.ChunkType)
+	byteArray = append(byteArray, sessionHeader.SourceIdentifier[:]...)
+	byteArray = append(byteArray, sessionHeader.TrailingBytes[:]...)
+	return byteArray
+}
+
+/*
+IsLastInSession returns whether no further transmissions follow in this session
+*/
+func (h SessionHeader) IsLastInSession() bool {
+	return h.TransmissionState == 1
+}
+
+/*
+Chunk is a fully reassembled chunk along with where and when it came from
+*/
+type Chunk struct {
+	ChunkTypeIdentifier uint32              // Numeric chunk type from the session header
+	ChunkType           string              // Chunk type name, resolved by the routing routine
+	SourceIdentifier    SourceIdentifier    // Identifier of the producing device
+	SessionNumber       uint32              // Session the chunk was transmitted in
+	ArrivalTime         time.Time           // When the last byte of the chunk arrived
+	JSONData            string              // The chunk serialised as JSON
+	binaryMessage       *binaryChunkMessage // Binary form shared by every copy, encoded when first needed
+}
+
+/*
+Routine safe table of numeric chunk type identifiers and their names.
+Identifiers may be configured up front or learnt from the JSON root key
+the first time a chunk type is seen
+*/
+type ChunkTypeRegistry struct {
+	mu                sync.RWMutex      // Mutex to protect access to the map
+	chunkTypeNameMap  map[uint32]string // Map of identifiers and chunk type names
+	learntIdentifiers map[uint32]bool   // Identifiers learnt rather than configured
+}
+
+/*
+Create a registry from a configured map of chunk type names and identifiers
+*/
+func NewChunkTypeRegistry(chunkTypeIdentifiers map[string]FlexibleInt) *ChunkTypeRegistry {
+
+	chunkTypeNameMap := make(map[uint32]string)
+	for chunkType, identifier := range chunkTypeIdentifiers {
+		chunkTypeNameMap[uint32(identifier)] = chunkType
+	}
+
+	registry := new(ChunkTypeRegistry)
+	registry.chunkTypeNameMap = chunkTypeNameMap
+	registry.learntIdentifiers = make(map[uint32]bool)
+
+	return registry
+}
+
+/*
+Look up the name of a chunk type identifier
+
+returns the name, whether the identifier is known and whether its name
+was learnt rather than configured
+*/
+func (r *ChunkTypeRegistry) Lookup(identifier uint32) (string, bool, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	chunkType, exists := r.chunkTypeNameMap[identifier]
+	return chunkType, exists, r.learntIdentifiers[identifier]
+}
+
+/*
+Remember the name of a chunk type identifier for later lookups
+*/
+func (r *ChunkTypeRegistry) Learn(identifier uint32, chunkType string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.chunkTypeNameMap[identifier] = chunkType
+	r.learntIdentifiers[identifier] = true
+}
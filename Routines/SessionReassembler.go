@@ -0,0 +1,229 @@
+package Routines
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrSessionNotStarted  = errors.New("transmission arrived for a session that was not started")
+	ErrSequenceGap        = errors.New("transmission arrived out of sequence")
+	ErrFirstFrameTooShort = errors.New("first transmission in session is too short")
+)
+
+/*
+ReassemblyError describes a transmission that could not be added to a
+session. The partial session it belonged to is dropped
+*/
+type ReassemblyError struct {
+	SourceIdentifier SourceIdentifier // Source of the transmission
+	SessionNumber    uint32           // Session of the transmission
+	SequenceNumber   uint32           // Sequence number that was received
+	Err              error            // Why the transmission was rejected
+}
+
+func (e *ReassemblyError) Error() string {
+	return fmt.Sprintf("%s: source %s session %d sequence %d", e.Err, e.SourceIdentifier, e.SessionNumber, e.SequenceNumber)
+}
+
+func (e *ReassemblyError) Unwrap() error {
+	return e.Err
+}
+
+/*
+Sessions are uniquely identified by the producing device and its session number
+*/
+type sessionKey struct {
+	sourceIdentifier SourceIdentifier
+	sessionNumber    uint32
+}
+
+type partialSession struct {
+	chunkTypeIdentifier  uint32                         // Chunk type of the session
+	nextSequenceNumber   uint32                         // Sequence number we expect next
+	JSONByteArray        []byte                         // Session data accumulated so far
+	pendingTransmissions map[uint32]pendingTransmission // Transmissions that arrived ahead of their turn
+	lastUpdate           time.Time                      // When a transmission last arrived
+}
+
+type pendingTransmission struct {
+	sessionData   []byte // Data of the transmission
+	lastInSession bool   // Whether it was the last in the session
+}
+
+/*
+SessionReassembler rebuilds chunks from session transmissions. Sessions
+from different sources, or different sessions from the same source, may
+be interleaved on one stream. Transmissions may also arrive up to the
+reorder window ahead of their turn, which is needed for datagram
+transports. A reassembler is not routine safe and is intended to be
+owned by a single receiver
+*/
+type SessionReassembler struct {
+	sessionMap        map[sessionKey]*partialSession // Partial sessions keyed on source and session number
+	completedSessions map[sessionKey]time.Time       // When recent sessions completed, kept while reordering
+	sessionTimeout    time.Duration                  // Partial sessions idle for longer than this are dropped
+	reorderWindow     uint32                         // How far ahead of the expected sequence a transmission may arrive
+}
+
+/*
+Create a reassembler that drops partial sessions idle for longer than
+sessionTimeout. A reorder window of 0 requires transmissions in order.
+With a reorder window, transmissions of a session that completed within
+the session timeout are duplicates or late and are dropped
+*/
+func NewSessionReassembler(sessionTimeout time.Duration, reorderWindow int) *SessionReassembler {
+	sessionReassembler := new(SessionReassembler)
+	sessionReassembler.sessionMap = make(map[sessionKey]*partialSession)
+	sessionReassembler.completedSessions = make(map[sessionKey]time.Time)
+	sessionReassembler.sessionTimeout = sessionTimeout
+	sessionReassembler.reorderWindow = uint32(reorderWindow)
+	return sessionReassembler
+}
+
+/*
+AddTransmission adds one transmission to its session.
+
+returns the chunk and true once every transmission of a session has
+been added, or a ReassemblyError if the transmission could not be
+placed in the session it belongs to
+*/
+func (r *SessionReassembler) AddTransmission(sessionHeader SessionHeader, sessionData []byte, arrivalTime time.Time) (Chunk, bool, error) {
+
+	key := sessionKey{sourceIdentifier: sessionHeader.SourceIdentifier, sessionNumber: sessionHeader.SessionNumber}
+	session, sessionExists := r.sessionMap[key]
+	sequenceNumber := sessionHeader.SequenceNumber
+
+	// Datagrams may be duplicated or arrive after their session completed
+	if completedTime, completed := r.completedSessions[key]; completed {
+		if arrivalTime.Sub(completedTime) <= r.sessionTimeout {
+			return Chunk{}, false, nil
+		}
+		delete(r.completedSessions, key)
+	}
+
+	// A first transmission for a session we are part way through means
+	// the producer started it again, unless datagrams may be duplicated
+	if sessionExists && sequenceNumber == 0 && session.nextSequenceNumber > 0 && r.reorderWindow == 0 {
+		delete(r.sessionMap, key)
+		sessionExists = false
+	}
+
+	// Only start sessions from transmissions close enough to the beginning
+	if !sessionExists {
+		if sequenceNumber > r.reorderWindow {
+			return Chunk{}, false, r.newError(sessionHeader, ErrSessionNotStarted)
+		}
+		session = new(partialSession)
+		session.chunkTypeIdentifier = sessionHeader.ChunkType
+		session.pendingTransmissions = make(map[uint32]pendingTransmission)
+		r.sessionMap[key] = session
+	}
+	session.lastUpdate = arrivalTime
+
+	if sequenceNumber < session.nextSequenceNumber && r.reorderWindow > 0 {
+		// A duplicate of something we already have
+		return Chunk{}, false, nil
+	} else if sequenceNumber != session.nextSequenceNumber {
+		if sequenceNumber < session.nextSequenceNumber || sequenceNumber-session.nextSequenceNumber > r.reorderWindow {
+			// We missed a transmission so the session cannot be completed
+			delete(r.sessionMap, key)
+			return Chunk{}, false, r.newError(sessionHeader, ErrSequenceGap)
+		}
+
+		// Hold on to it until the transmissions before it arrive
+		session.pendingTransmissions[sequenceNumber] = pendingTransmission{
+			sessionData:   append([]byte(nil), sessionData...),
+			lastInSession: sessionHeader.IsLastInSession(),
+		}
+		return Chunk{}, false, nil
+	}
+
+	// Add this transmission and any that were waiting on it
+	lastInSession := sessionHeader.IsLastInSession()
+	for {
+		if session.nextSequenceNumber == 0 {
+			// The first transmission holds the length of the chunk before the JSON
+			JSONStartIndex := GetJSONStartIndex()
+			if len(sessionData) < JSONStartIndex {
+				delete(r.sessionMap, key)
+				return Chunk{}, false, r.newError(sessionHeader, ErrFirstFrameTooShort)
+			}
+			sessionData = sessionData[JSONStartIndex:]
+		}
+
+		session.JSONByteArray = append(session.JSONByteArray, sessionData...)
+		session.nextSequenceNumber++
+
+		if lastInSession {
+			break
+		}
+
+		pending, isPending := session.pendingTransmissions[session.nextSequenceNumber]
+		if !isPending {
+			return Chunk{}, false, nil
+		}
+		delete(session.pendingTransmissions, session.nextSequenceNumber)
+		sessionData = pending.sessionData
+		lastInSession = pending.lastInSession
+	}
+
+	// We have finished the session so we can pass it on
+	delete(r.sessionMap, key)
+	if r.reorderWindow > 0 {
+		r.completedSessions[key] = arrivalTime
+	}
+	chunk := Chunk{
+		ChunkTypeIdentifier: session.chunkTypeIdentifier,
+		SourceIdentifier:    sessionHeader.SourceIdentifier,
+		SessionNumber:       sessionHeader.SessionNumber,
+		ArrivalTime:         arrivalTime,
+		JSONData:            string(session.JSONByteArray),
+	}
+	return chunk, true, nil
+}
+
+/*
+DropStaleSessions removes partial sessions that have not received a
+transmission within the session timeout, and forgets sessions that
+completed before it
+
+returns the number of partial sessions dropped
+*/
+func (r *SessionReassembler) DropStaleSessions(now time.Time) int {
+	for key, completedTime := range r.completedSessions {
+		if now.Sub(completedTime) > r.sessionTimeout {
+			delete(r.completedSessions, key)
+		}
+	}
+
+	droppedSessions := 0
+	for key, session := range r.sessionMap {
+		if now.Sub(session.lastUpdate) > r.sessionTimeout {
+			delete(r.sessionMap, key)
+			droppedSessions++
+		}
+	}
+	return droppedSessions
+}
+
+/*
+Number of sessions currently being reassembled
+*/
+func (r *SessionReassembler) PartialSessionCount() int {
+	return len(r.sessionMap)
+}
+
+func (r *SessionReassembler) newError(sessionHeader SessionHeader, err error) *ReassemblyError {
+	return &ReassemblyError{
+		SourceIdentifier: sessionHeader.SourceIdentifier,
+		SessionNumber:    sessionHeader.SessionNumber,
+		SequenceNumber:   sessionHeader.SequenceNumber,
+		Err:              err,
+	}
+}
+
+func GetJSONStartIndex() int {
+	return 4
+}
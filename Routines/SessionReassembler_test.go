@@ -0,0 +1,243 @@
+package Routines
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+const testSessionTimeout = 10 * time.Second
+
+var (
+	testSourceA = SourceIdentifier{2, 0, 0, 0, 0, 1}
+	testSourceB = SourceIdentifier{2, 0, 0, 0, 0, 2}
+)
+
+type testTransmission struct {
+	source         SourceIdentifier
+	sessionNumber  uint32
+	sequenceNumber uint32
+	lastInSession  bool
+	sessionData    string
+}
+
+/*
+Split a chunk's JSON into transmissions of a session, with the chunk length
+the producer places before the JSON in the first one
+*/
+func splitTestSession(source SourceIdentifier, sessionNumber uint32, JSONParts ...string) []testTransmission {
+	transmissions := make([]testTransmission, len(JSONParts))
+	for index, JSONPart := range JSONParts {
+		if index == 0 {
+			JSONPart = "\x00\x00\x00\x00" + JSONPart
+		}
+		transmissions[index] = testTransmission{
+			source:         source,
+			sessionNumber:  sessionNumber,
+			sequenceNumber: uint32(index),
+			lastInSession:  index == len(JSONParts)-1,
+			sessionData:    JSONPart,
+		}
+	}
+	return transmissions
+}
+
+func addTestTransmission(sessionReassembler *SessionReassembler, transmission testTransmission, arrivalTime time.Time) (Chunk, bool, error) {
+	sessionHeader := SessionHeader{
+		SessionNumber:    transmission.sessionNumber,
+		SequenceNumber:   transmission.sequenceNumber,
+		ChunkType:        1,
+		SourceIdentifier: transmission.source,
+	}
+	if transmission.lastInSession {
+		sessionHeader.TransmissionState = 1
+	}
+	return sessionReassembler.AddTransmission(sessionHeader, []byte(transmission.sessionData), arrivalTime)
+}
+
+/*
+Add transmissions in order, failing on any error, and collect the chunks completed
+*/
+func addTestTransmissions(t *testing.T, sessionReassembler *SessionReassembler, transmissions []testTransmission, arrivalTime time.Time) []Chunk {
+	t.Helper()
+
+	var chunks []Chunk
+	for _, transmission := range transmissions {
+		chunk, complete, err := addTestTransmission(sessionReassembler, transmission, arrivalTime)
+		if err != nil {
+			t.Fatalf("sequence %d of session %d from %s: %v", transmission.sequenceNumber, transmission.sessionNumber, transmission.source, err)
+		}
+		if complete {
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks
+}
+
+func TestSessionReassemblerInterleavedSources(t *testing.T) {
+	sessionReassembler := NewSessionReassembler(testSessionTimeout, 0)
+	sessionA := splitTestSession(testSourceA, 5, `{"TimeChunk":`, `{"Source":"A"}}`)
+	sessionB := splitTestSession(testSourceB, 5, `{"TimeChunk":`, `{"Source":"B"}}`)
+
+	transmissions := []testTransmission{sessionA[0], sessionB[0], sessionB[1], sessionA[1]}
+	chunks := addTestTransmissions(t, sessionReassembler, transmissions, time.Now())
+
+	if len(chunks) != 2 {
+		t.Fatalf("completed %d chunks, want 2", len(chunks))
+	}
+	if chunks[0].SourceIdentifier != testSourceB || chunks[0].JSONData != `{"TimeChunk":{"Source":"B"}}` {
+		t.Errorf("first chunk is %s %s, want source B", chunks[0].SourceIdentifier, chunks[0].JSONData)
+	}
+	if chunks[1].SourceIdentifier != testSourceA || chunks[1].JSONData != `{"TimeChunk":{"Source":"A"}}` {
+		t.Errorf("second chunk is %s %s, want source A", chunks[1].SourceIdentifier, chunks[1].JSONData)
+	}
+	if chunks[1].SessionNumber != 5 || chunks[1].ChunkTypeIdentifier != 1 {
+		t.Errorf("chunk has session %d and chunk type %d, want 5 and 1", chunks[1].SessionNumber, chunks[1].ChunkTypeIdentifier)
+	}
+	if sessionReassembler.PartialSessionCount() != 0 {
+		t.Errorf("%d partial sessions left, want 0", sessionReassembler.PartialSessionCount())
+	}
+}
+
+func TestSessionReassemblerSequenceGap(t *testing.T) {
+	sessionReassembler := NewSessionReassembler(testSessionTimeout, 0)
+	session := splitTestSession(testSourceA, 5, `{"TimeChunk":`, `{"Channels":`, `[]}}`)
+	arrivalTime := time.Now()
+
+	addTestTransmissions(t, sessionReassembler, session[:1], arrivalTime)
+	_, complete, err := addTestTransmission(sessionReassembler, session[2], arrivalTime)
+
+	var reassemblyError *ReassemblyError
+	if complete || !errors.As(err, &reassemblyError) || !errors.Is(err, ErrSequenceGap) {
+		t.Fatalf("AddTransmission returned %v, %v, want an ErrSequenceGap", complete, err)
+	}
+	if reassemblyError.SourceIdentifier != testSourceA || reassemblyError.SessionNumber != 5 || reassemblyError.SequenceNumber != 2 {
+		t.Errorf("error is %+v, want source A session 5 sequence 2", reassemblyError)
+	}
+	if sessionReassembler.PartialSessionCount() != 0 {
+		t.Errorf("%d partial sessions left, want the session discarded", sessionReassembler.PartialSessionCount())
+	}
+
+	// The rest of the discarded session no longer has a session to join
+	if _, _, err := addTestTransmission(sessionReassembler, session[1], arrivalTime); !errors.Is(err, ErrSessionNotStarted) {
+		t.Errorf("AddTransmission returned %v, want ErrSessionNotStarted", err)
+	}
+}
+
+func TestSessionReassemblerRestartedSession(t *testing.T) {
+	sessionReassembler := NewSessionReassembler(testSessionTimeout, 0)
+	abandonedSession := splitTestSession(testSourceA, 5, `{"Old":`, `{}}`)
+	session := splitTestSession(testSourceA, 5, `{"TimeChunk":`, `{}}`)
+
+	transmissions := append([]testTransmission{abandonedSession[0]}, session...)
+	chunks := addTestTransmissions(t, sessionReassembler, transmissions, time.Now())
+
+	if len(chunks) != 1 || chunks[0].JSONData != `{"TimeChunk":{}}` {
+		t.Fatalf("completed %+v, want only the restarted session", chunks)
+	}
+}
+
+func TestSessionReassemblerStaleSessions(t *testing.T) {
+	sessionReassembler := NewSessionReassembler(testSessionTimeout, 0)
+	staleSession := splitTestSession(testSourceA, 5, `{"TimeChunk":`, `{}}`)
+	activeSession := splitTestSession(testSourceB, 5, `{"TimeChunk":`, `{}}`)
+	startTime := time.Now()
+
+	addTestTransmissions(t, sessionReassembler, staleSession[:1], startTime)
+	addTestTransmissions(t, sessionReassembler, activeSession[:1], startTime.Add(testSessionTimeout/2))
+
+	if droppedSessions := sessionReassembler.DropStaleSessions(startTime.Add(testSessionTimeout)); droppedSessions != 0 {
+		t.Fatalf("dropped %d sessions at the timeout, want 0", droppedSessions)
+	}
+	if droppedSessions := sessionReassembler.DropStaleSessions(startTime.Add(testSessionTimeout + time.Second)); droppedSessions != 1 {
+		t.Fatalf("dropped %d sessions after the timeout, want 1", droppedSessions)
+	}
+
+	if _, _, err := addTestTransmission(sessionReassembler, staleSession[1], startTime.Add(testSessionTimeout+time.Second)); !errors.Is(err, ErrSessionNotStarted) {
+		t.Errorf("stale session returned %v, want ErrSessionNotStarted", err)
+	}
+	if chunks := addTestTransmissions(t, sessionReassembler, activeSession[1:], startTime.Add(testSessionTimeout+time.Second)); len(chunks) != 1 {
+		t.Errorf("active session completed %d chunks, want 1", len(chunks))
+	}
+}
+
+func TestSessionReassemblerFirstFrameTooShort(t *testing.T) {
+	sessionReassembler := NewSessionReassembler(testSessionTimeout, 0)
+	transmission := testTransmission{source: testSourceA, sessionNumber: 5, sessionData: "\x00\x00"}
+
+	if _, _, err := addTestTransmission(sessionReassembler, transmission, time.Now()); !errors.Is(err, ErrFirstFrameTooShort) {
+		t.Errorf("AddTransmission returned %v, want ErrFirstFrameTooShort", err)
+	}
+}
+
+func TestSessionReassemblerReorderWindow(t *testing.T) {
+	sessionReassembler := NewSessionReassembler(testSessionTimeout, 2)
+	session := splitTestSession(testSourceA, 5, `{"TimeChunk":`, `{"Channels":`, `[]`, `}}`)
+
+	transmissions := []testTransmission{session[2], session[0], session[3], session[1]}
+	chunks := addTestTransmissions(t, sessionReassembler, transmissions, time.Now())
+
+	if len(chunks) != 1 || chunks[0].JSONData != `{"TimeChunk":{"Channels":[]}}` {
+		t.Fatalf("completed %+v, want the session in order", chunks)
+	}
+}
+
+func TestSessionReassemblerBeyondReorderWindow(t *testing.T) {
+	sessionReassembler := NewSessionReassembler(testSessionTimeout, 1)
+	session := splitTestSession(testSourceA, 5, `{"TimeChunk":`, `{"Channels":`, `[]`, `}}`)
+
+	addTestTransmissions(t, sessionReassembler, session[:1], time.Now())
+	if _, _, err := addTestTransmission(sessionReassembler, session[3], time.Now()); !errors.Is(err, ErrSequenceGap) {
+		t.Errorf("AddTransmission returned %v, want ErrSequenceGap", err)
+	}
+}
+
+func TestSessionReassemblerDuplicates(t *testing.T) {
+	testCases := []struct {
+		name      string
+		duplicate int
+	}{
+		{"first", 0},
+		{"middle", 1},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			sessionReassembler := NewSessionReassembler(testSessionTimeout, 2)
+			session := splitTestSession(testSourceA, 5, `{"TimeChunk":`, `{"Channels":`, `[]}}`)
+
+			transmissions := []testTransmission{session[0], session[1], session[testCase.duplicate], session[2]}
+			chunks := addTestTransmissions(t, sessionReassembler, transmissions, time.Now())
+
+			if len(chunks) != 1 || chunks[0].JSONData != `{"TimeChunk":{"Channels":[]}}` {
+				t.Fatalf("completed %+v, want the session once", chunks)
+			}
+		})
+	}
+}
+
+func TestSessionReassemblerCompletedSessions(t *testing.T) {
+	sessionReassembler := NewSessionReassembler(testSessionTimeout, 2)
+	session := splitTestSession(testSourceA, 5, `{"TimeChunk":`, `{}}`)
+	startTime := time.Now()
+
+	if chunks := addTestTransmissions(t, sessionReassembler, session, startTime); len(chunks) != 1 {
+		t.Fatalf("completed %d chunks, want 1", len(chunks))
+	}
+
+	// Late and duplicated datagrams of the completed session are dropped
+	lateTime := startTime.Add(testSessionTimeout / 2)
+	if chunks := addTestTransmissions(t, sessionReassembler, session, lateTime); len(chunks) != 0 {
+		t.Errorf("completed %d chunks from late datagrams, want 0", len(chunks))
+	}
+	if sessionReassembler.PartialSessionCount() != 0 {
+		t.Errorf("%d partial sessions left, want 0", sessionReassembler.PartialSessionCount())
+	}
+
+	// Once forgotten the session number may be used again
+	reuseTime := startTime.Add(2 * testSessionTimeout)
+	sessionReassembler.DropStaleSessions(reuseTime)
+	if chunks := addTestTransmissions(t, sessionReassembler, session, reuseTime); len(chunks) != 1 {
+		t.Errorf("completed %d chunks after the session was forgotten, want 1", len(chunks))
+	}
+}
@@ -0,0 +1,366 @@
+package Routines
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SimulatorRoutineName = "Simulator"
+
+// How long a producer waits before connecting again after losing the adapter
+const simulatorReconnectInterval = time.Second
+
+/*
+SimulatorOptions controls the synthetic sensor nodes run by the simulate command
+*/
+type SimulatorOptions struct {
+	Address                 string           // Host and port of the TCP receiver
+	Producers               int              // Sensor nodes simulated, each on its own connection
+	SourceIdentifier        SourceIdentifier // Identifier of the first node, later nodes count up from it
+	SampleRate              int              // Samples per second of each channel
+	Channels                int              // Channels in each TimeChunk
+	ChunkSize               int              // Samples per channel in each chunk, a power of 2
+	ToneFrequencies         []float64        // Frequencies of the tones summed on every channel in Hz
+	ToneAmplitude           float64          // Amplitude of each tone as a fraction of full scale
+	NoiseAmplitude          float64          // Standard deviation of the noise as a fraction of full scale
+	SendFFTMagnitudeChunks  bool             // Also send the FFT magnitude of every TimeChunk
+	TimeChunkTypeIdentifier uint32           // Session header chunk type of TimeChunks
+	FFTChunkTypeIdentifier  uint32           // Session header chunk type of FFTMagnitudeChunks
+	MaxFrameSize            int              // Largest frame sent, including the frame headers
+	Speed                   float64          // Multiplier on the real time chunk rate, 0 to send as fast as possible
+	ChunkCount              int              // Chunks sent by each node before stopping, 0 for no limit
+	DropRate                float64          // Probability of leaving out each transmission
+	CorruptLengthRate       float64          // Probability of corrupting the length of each frame
+	TLSConfig               *tls.Config      // Connect over TLS when set
+}
+
+/*
+SimulatedTimeChunk is the JSON body of the TimeChunks the simulator sends
+*/
+type SimulatedTimeChunk struct {
+	SourceIdentifier string          // Identifier of the simulated node
+	ChunkSize        int             // Samples per channel
+	SampleRate       int             // Samples per second of each channel
+	TimeStamp        int64           // Unix time in milliseconds of the first sample
+	NumBytes         int             // Bytes per sample
+	NumChannels      int             // Number of channels
+	Channels         map[int][]int16 // Samples of each channel
+}
+
+/*
+SimulatedFFTMagnitudeChunk is the JSON body of the FFTMagnitudeChunks the simulator sends
+*/
+type SimulatedFFTMagnitudeChunk struct {
+	SourceIdentifier string            // Identifier of the simulated node
+	ChunkSize        int               // Frequency bins per channel
+	SampleRate       int               // Samples per second of the time data
+	TimeStamp        int64             // Unix time in milliseconds of the first sample
+	NumChannels      int               // Number of channels
+	Channels         map[int][]float32 // Magnitude of each bin from 0 Hz to half the sample rate
+}
+
+/*
+RunSimulator connects one TCP connection per simulated node and sends
+framed sessions holding TimeChunks and, optionally, FFTMagnitudeChunks.
+Dropped transmissions and corrupt frame lengths may be injected to
+exercise the receiver. Nodes reconnect if the adapter goes away
+*/
+func RunSimulator(ctx context.Context, simulatorOptions SimulatorOptions, routineHealth *RoutineHealth, logger *Logger) error {
+
+	if simulatorOptions.ChunkSize < 2 || simulatorOptions.ChunkSize&(simulatorOptions.ChunkSize-1) != 0 {
+		return fmt.Errorf("chunk size %d is not a power of 2", simulatorOptions.ChunkSize)
+	}
+	if simulatorOptions.MaxFrameSize <= FrameHeaderSize+GetJSONStartIndex() || simulatorOptions.MaxFrameSize > math.MaxUint16 {
+		return fmt.Errorf("maximum frame size %d must be between %d and %d", simulatorOptions.MaxFrameSize, FrameHeaderSize+GetJSONStartIndex()+1, math.MaxUint16)
+	}
+
+	logger.Info("Simulating sensor nodes", "address", simulatorOptions.Address, "producers", simulatorOptions.Producers,
+		"sample_rate", simulatorOptions.SampleRate, "channels", simulatorOptions.Channels)
+	routineHealth.SetRoutineState(SimulatorRoutineName, RoutineRunning, "Sending to "+simulatorOptions.Address)
+
+	var producerWaitGroup sync.WaitGroup
+	for producerIndex := 0; producerIndex < simulatorOptions.Producers; producerIndex++ {
+
+		// Each node counts up from the configured identifier
+		sourceIdentifier := simulatorOptions.SourceIdentifier
+		binary.BigEndian.PutUint16(sourceIdentifier[4:], binary.BigEndian.Uint16(sourceIdentifier[4:])+uint16(producerIndex))
+
+		producerWaitGroup.Add(1)
+		go func() {
+			defer producerWaitGroup.Done()
+			runSimulatedProducer(ctx, simulatorOptions, sourceIdentifier, logger.With("source", sourceIdentifier))
+		}()
+	}
+	producerWaitGroup.Wait()
+
+	logger.Info("Stopped simulating sensor nodes")
+	routineHealth.SetRoutineState(SimulatorRoutineName, RoutineStopped, "")
+	return nil
+}
+
+/*
+Send chunks from a single simulated node until the chunk count is
+reached or we are asked to stop
+*/
+func runSimulatedProducer(ctx context.Context, simulatorOptions SimulatorOptions, sourceIdentifier SourceIdentifier, logger *Logger) {
+
+	// Each node has its own noise so that sources can be told apart
+	random := rand.New(rand.NewSource(time.Now().UnixNano() + int64(binary.BigEndian.Uint16(sourceIdentifier[4:]))))
+
+	// Chunks are paced by how long their samples would take to record
+	chunkInterval := time.Duration(0)
+	if simulatorOptions.Speed > 0 {
+		chunkInterval = time.Duration(float64(simulatorOptions.ChunkSize) / float64(simulatorOptions.SampleRate) / simulatorOptions.Speed * float64(time.Second))
+	}
+
+	var connection net.Conn
+	defer func() {
+		if connection != nil {
+			connection.Close()
+		}
+	}()
+
+	var sessionNumber uint32
+	var sampleIndex int
+	nextChunkTime := time.Now()
+
+	for chunkIndex := 0; simulatorOptions.ChunkCount == 0 || chunkIndex < simulatorOptions.ChunkCount; chunkIndex++ {
+
+		// Wait until the chunk would have been recorded
+		if waitTime := time.Until(nextChunkTime); waitTime > 0 {
+			waitTimer := time.NewTimer(waitTime)
+			select {
+			case <-waitTimer.C:
+			case <-ctx.Done():
+				waitTimer.Stop()
+				return
+			}
+		} else if ctx.Err() != nil {
+			return
+		}
+		nextChunkTime = nextChunkTime.Add(chunkInterval)
+
+		// Connect, or connect again after losing the adapter
+		for connection == nil {
+			var dialer net.Dialer
+			var err error
+			if simulatorOptions.TLSConfig != nil {
+				tlsDialer := tls.Dialer{NetDialer: &dialer, Config: simulatorOptions.TLSConfig}
+				connection, err = tlsDialer.DialContext(ctx, "tcp", simulatorOptions.Address)
+			} else {
+				connection, err = dialer.DialContext(ctx, "tcp", simulatorOptions.Address)
+			}
+			if ctx.Err() != nil {
+				return
+			} else if err != nil {
+				logger.Warn("Could not connect, retrying", "address", simulatorOptions.Address, "error", err)
+				select {
+				case <-time.After(simulatorReconnectInterval):
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+			logger.Info("Connected", "address", simulatorOptions.Address)
+			nextChunkTime = time.Now()
+		}
+
+		// Generate the chunk and its spectrum
+		timeStamp := time.Now().UnixMilli()
+		channelSamples := simulateChannelSamples(simulatorOptions, sampleIndex, random)
+		sampleIndex += simulatorOptions.ChunkSize
+
+		var byteArray []byte
+		timeChunkJSON, _ := json.Marshal(map[string]SimulatedTimeChunk{"TimeChunk": {
+			SourceIdentifier: sourceIdentifier.String(),
+			ChunkSize:        simulatorOptions.ChunkSize,
+			SampleRate:       simulatorOptions.SampleRate,
+			TimeStamp:        timeStamp,
+			NumBytes:         2,
+			NumChannels:      simulatorOptions.Channels,
+			Channels:         channelSamples,
+		}})
+		sessionNumber++
+		byteArray = appendSimulatedSession(byteArray, simulatorOptions, SessionHeader{
+			SessionNumber:    sessionNumber,
+			ChunkType:        simulatorOptions.TimeChunkTypeIdentifier,
+			SourceIdentifier: sourceIdentifier,
+		}, timeChunkJSON, random)
+
+		if simulatorOptions.SendFFTMagnitudeChunks {
+			fftChunkJSON, _ := json.Marshal(map[string]SimulatedFFTMagnitudeChunk{"FFTMagnitudeChunk": {
+				SourceIdentifier: sourceIdentifier.String(),
+				ChunkSize:        simulatorOptions.ChunkSize/2 + 1,
+				SampleRate:       simulatorOptions.SampleRate,
+				TimeStamp:        timeStamp,
+				NumChannels:      simulatorOptions.Channels,
+				Channels:         fftMagnitudes(channelSamples),
+			}})
+			sessionNumber++
+			byteArray = appendSimulatedSession(byteArray, simulatorOptions, SessionHeader{
+				SessionNumber:    sessionNumber,
+				ChunkType:        simulatorOptions.FFTChunkTypeIdentifier,
+				SourceIdentifier: sourceIdentifier,
+			}, fftChunkJSON, random)
+		}
+
+		if _, err := connection.Write(byteArray); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Warn("Connection lost, reconnecting", "error", err)
+			connection.Close()
+			connection = nil
+		}
+	}
+}
+
+/*
+Append every frame of one session to the byte array. The first
+transmission starts with the length of the chunk before its JSON, and
+the session is split into transmissions that fit the maximum frame size
+*/
+func appendSimulatedSession(byteArray []byte, simulatorOptions SimulatorOptions, sessionHeader SessionHeader, chunkJSON []byte, random *rand.Rand) []byte {
+
+	sessionData := binary.LittleEndian.AppendUint32(make([]byte, 0, GetJSONStartIndex()+len(chunkJSON)), uint32(len(chunkJSON)))
+	sessionData = append(sessionData, chunkJSON...)
+
+	transmissionSize := simulatorOptions.MaxFrameSize - FrameHeaderSize
+	for sequenceNumber := 0; sequenceNumber*transmissionSize < len(sessionData); sequenceNumber++ {
+		start := sequenceNumber * transmissionSize
+		end := min(start+transmissionSize, len(sessionData))
+
+		sessionHeader.SequenceNumber = uint32(sequenceNumber)
+		sessionHeader.TransmissionState = 0
+		if end == len(sessionData) {
+			sessionHeader.TransmissionState = 1
+		}
+
+		// Fault injection
+		if random.Float64() < simulatorOptions.DropRate {
+			continue
+		}
+		frameStart := len(byteArray)
+		byteArray = AppendFrame(byteArray, sessionHeader, sessionData[start:end])
+		if random.Float64() < simulatorOptions.CorruptLengthRate {
+			binary.LittleEndian.PutUint16(byteArray[frameStart:], uint16(random.Intn(math.MaxUint16+1)))
+		}
+	}
+
+	return byteArray
+}
+
+/*
+Sum the tones and noise on every channel, shifting the phase of each
+channel so that they can be told apart
+*/
+func simulateChannelSamples(simulatorOptions SimulatorOptions, sampleIndex int, random *rand.Rand) map[int][]int16 {
+	channelSamples := make(map[int][]int16, simulatorOptions.Channels)
+
+	for channelIndex := 0; channelIndex < simulatorOptions.Channels; channelIndex++ {
+		phaseOffset := 2 * math.Pi * float64(channelIndex) / float64(simulatorOptions.Channels)
+		samples := make([]int16, simulatorOptions.ChunkSize)
+
+		for index := range samples {
+			sampleTime := float64(sampleIndex+index) / float64(simulatorOptions.SampleRate)
+			value := random.NormFloat64() * simulatorOptions.NoiseAmplitude
+			for _, toneFrequency := range simulatorOptions.ToneFrequencies {
+				value += simulatorOptions.ToneAmplitude * math.Sin(2*math.Pi*toneFrequency*sampleTime+phaseOffset)
+			}
+			samples[index] = int16(max(-1, min(1, value)) * math.MaxInt16)
+		}
+		channelSamples[channelIndex] = samples
+	}
+
+	return channelSamples
+}
+
+/*
+Magnitude of the positive frequency bins of every channel, normalised
+so that a full scale tone has a magnitude of 1
+*/
+func fftMagnitudes(channelSamples map[int][]int16) map[int][]float32 {
+	channelMagnitudes := make(map[int][]float32, len(channelSamples))
+
+	for channelIndex, samples := range channelSamples {
+		spectrum := make([]complex128, len(samples))
+		for index, sample := range samples {
+			spectrum[index] = complex(float64(sample)/math.MaxInt16, 0)
+		}
+		fastFourierTransform(spectrum)
+
+		magnitudes := make([]float32, len(samples)/2+1)
+		for index := range magnitudes {
+			magnitudes[index] = float32(2 * cmplx.Abs(spectrum[index]) / float64(len(samples)))
+		}
+		channelMagnitudes[channelIndex] = magnitudes
+	}
+
+	return channelMagnitudes
+}
+
+/*
+In place iterative radix 2 FFT. The length must be a power of 2
+*/
+func fastFourierTransform(values []complex128) {
+	length := len(values)
+
+	// Reorder by bit reversed index
+	for index, reversedIndex := 1, 0; index < length; index++ {
+		bit := length >> 1
+		for ; reversedIndex&bit != 0; bit >>= 1 {
+			reversedIndex ^= bit
+		}
+		reversedIndex ^= bit
+		if index < reversedIndex {
+			values[index], values[reversedIndex] = values[reversedIndex], values[index]
+		}
+	}
+
+	// Then combine ever larger transforms
+	for size := 2; size <= length; size <<= 1 {
+		twiddleStep := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < length; start += size {
+			twiddle := complex(1, 0)
+			for offset := 0; offset < size/2; offset++ {
+				even := values[start+offset]
+				odd := values[start+offset+size/2] * twiddle
+				values[start+offset] = even + odd
+				values[start+offset+size/2] = even - odd
+				twiddle *= twiddleStep
+			}
+		}
+	}
+}
+
+/*
+ParseToneFrequencies reads a comma separated list of frequencies in Hz
+*/
+func ParseToneFrequencies(frequencyList string) ([]float64, error) {
+	var toneFrequencies []float64
+	if frequencyList == "" {
+		return toneFrequencies, nil
+	}
+
+	for _, frequencyString := range strings.Split(frequencyList, ",") {
+		frequencyString = strings.TrimSpace(frequencyString)
+		toneFrequency, err := strconv.ParseFloat(frequencyString, 64)
+		if err != nil || toneFrequency < 0 {
+			return nil, errors.New("tone frequency " + strconv.Quote(frequencyString) + " is not a frequency in Hz")
+		}
+		toneFrequencies = append(toneFrequencies, toneFrequency)
+	}
+	return toneFrequencies, nil
+}
@@ -1,224 +1,228 @@
 package Routines
 
 import (
-	"encoding/binary"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
 	"net"
-	"os"
+	"sync"
+	"time"
+)
 
-	"github.com/rs/zerolog"
+// Bounds of the wait between failed Accept or ReadFrom calls
+const (
+	minRetryDelay = 5 * time.Millisecond
+	maxRetryDelay = time.Second
 )
 
 /*
-getSessionStates is a partial implementation to extract transmission states of TCP and UDP Headers
-
-returns [transmissionState, sessionNumber, sequenceNumber, transmissionSize]
+Double the wait before retrying a failed call, starting from the minimum
 */
+func nextRetryDelay(retryDelay time.Duration) time.Duration {
+	if retryDelay == 0 {
+		return minRetryDelay
+	}
+	return min(2*retryDelay, maxRetryDelay)
+}
 
-func HandleTCPReceivals(configJson map[string]interface{}, loggingChannel chan map[zerolog.Level]string, dataChannel chan<- string) {
+func HandleTCPReceivals(ctx context.Context, tcpRxConfig TCPRxConfig, routineHealth *RoutineHealth, logger *Logger, dataChannel chan<- Chunk) error {
 
 	// Define the TCP port to listen on
-	var port string
-	if TCPRxConfig, exists := configJson["TCPRxConfig"].(map[string]interface{}); exists {
-		port = TCPRxConfig["Port"].(string)
-	} else {
-		loggingChannel <- CreateLogMessage(zerolog.FatalLevel, "TCPRx Config not found")
-		os.Exit(1)
-		return
+	var port = tcpRxConfig.Port.String()
+	var maxConnections = int(tcpRxConfig.MaxConnections)
+	var maxFrameSize = int(tcpRxConfig.MaxFrameSizeBytes)
+	var sessionTimeout = time.Duration(tcpRxConfig.SessionTimeoutSeconds) * time.Second
+
+	// Optionally require TLS, and client certificates signed by our CA
+	var tlsConfig *tls.Config
+	if tcpRxConfig.TLSCertificateFile != "" {
+		certificateReloader, err := NewCertificateReloader(tcpRxConfig.TLSCertificateFile, tcpRxConfig.TLSKeyFile, logger)
+		if err != nil {
+			return err
+		}
+		if tlsConfig, err = NewServerTLSConfig(certificateReloader, tcpRxConfig.ClientCAFile); err != nil {
+			return err
+		}
 	}
 
 	// Create a TCP listener on the specified port
 	listener, err := net.Listen("tcp", ":"+port)
 	if err != nil {
-		loggingChannel <- CreateLogMessage(zerolog.FatalLevel, "Error:"+err.Error())
-		os.Exit(1)
+		return err
 	}
-	defer listener.Close()
-	loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "TCP server is listening on port:"+port)
-
-	for {
-
-		conn, err := listener.Accept()
-		if err != nil {
-			loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "Error:"+err.Error())
-		}
-		loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "TCP server is connected on port:"+port)
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	logger.Info("TCP server is listening", "port", port, "tls", tlsConfig != nil, "client_certificates", tcpRxConfig.ClientCAFile != "")
+	routineHealth.SetRoutineState(TCPRxRoutineName, RoutineRunning, "Listening on "+listener.Addr().String())
 
-		// Accept incoming TCP connections
-		defer conn.Close()
+	// Closing the listener on shutdown unblocks Accept
+	stopListening := context.AfterFunc(ctx, func() {
+		listener.Close()
+	})
+	defer stopListening()
 
-		// Create a buffer to read incoming data
+	// Each connection holds a slot until it closes
+	connectionSlots := make(chan struct{}, maxConnections)
 
-		var byteArray []byte
-		var JSONByteArray []byte
+	// And we wait for every connection to finish before returning
+	var connectionWaitGroup sync.WaitGroup
+	defer connectionWaitGroup.Wait()
 
-		previousSessionNumber := uint32(0)
-		previousSequenceNumber := uint32(0)
-		sessionContinuous := false
-		newSequence := false
-		LastInSequence := false
+	// Backs off while Accept keeps failing
+	var acceptRetryDelay time.Duration
 
-		for {
+	for {
 
-			// Read data from the connection into the buffer
-			buffer := make([]byte, 512)
-			bytesRead, err := conn.Read(buffer)
-			if bytesRead == 0 {
-				loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "Connection from "+conn.RemoteAddr().String()+" closed")
-				break
-			} else if err != nil {
-				loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "Error reading:"+err.Error())
-				break
+		// Accept incoming TCP connections
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				logger.Info("TCP server stopped listening", "port", port)
+				routineHealth.SetRoutineState(TCPRxRoutineName, RoutineStopped, "")
+				return nil
 			}
 
-			byteArray = append(byteArray, buffer[:bytesRead]...)
-
-			// check if byte array is large enough
-			if len(byteArray) > 4096 {
-
-				// Expected byte Format
-				// |Transport Header(2)| [Session Header(23)|Session Data(x)] |
+			// Errors such as running out of file descriptors
+			// persist for a while, so wait before trying again
+			acceptRetryDelay = nextRetryDelay(acceptRetryDelay)
+			logger.Error("Error accepting connection", "error", err, "retry_delay", acceptRetryDelay.String())
+			select {
+			case <-time.After(acceptRetryDelay):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		acceptRetryDelay = 0
+
+		// Then reject the connection if we are already at capacity
+		select {
+		case connectionSlots <- struct{}{}:
+		default:
+			logger.Warn("Rejecting connection, already at capacity",
+				"remote_address", conn.RemoteAddr().String(), "max_connections", maxConnections)
+			conn.Close()
+			continue
+		}
+		logger.Info("TCP server is connected", "port", port, "remote_address", conn.RemoteAddr().String())
+
+		// And service each producer in its own routine
+		connectionWaitGroup.Add(1)
+		go func() {
+			defer connectionWaitGroup.Done()
+			defer func() { <-connectionSlots }()
+			routineHealth.ProducerConnected()
+			defer routineHealth.ProducerDisconnected()
+			HandleTCPConnection(ctx, conn, maxFrameSize, sessionTimeout, logger, dataChannel)
+		}()
+	}
 
-				// Lets first check how many bytes in the transport layer message
-				TransportLayerHeaderSize_bytes := 2
-				TransportLayerDataSize := binary.LittleEndian.Uint16(byteArray[:TransportLayerHeaderSize_bytes])
+}
 
-				if TransportLayerDataSize > 4096 {
-					continue
-				}
+func HandleTCPConnection(ctx context.Context, conn net.Conn, maxFrameSize int, sessionTimeout time.Duration, logger *Logger, dataChannel chan<- Chunk) {
 
-				//loggingChannel <- CreateLogMessage(zerolog.DebugLevel, "TransportLayerDataSize:"+fmt.Sprint(TransportLayerDataSize))
-
-				// The carry on and extract session state information (v1.0.0 of chunk types)
-				SessionLayerHeaderSize_bytes := 23
-				transmissionSize := TransportLayerDataSize
-				TCPHeaderBytes := byteArray[TransportLayerHeaderSize_bytes : SessionLayerHeaderSize_bytes+TransportLayerHeaderSize_bytes]
-				transmissionState, sessionNumber, sequenceNumber := ConvertBytesToSessionStates(TCPHeaderBytes)
-				// loggingChannel <- CreateLogMessage(zerolog.DebugLevel, "States: Transmission State "+string(transmissionState)+
-				// 	" Session Number "+fmt.Sprint(sessionNumber)+
-				// 	" Sequence Number "+fmt.Sprint(sequenceNumber)+
-				// 	" Transmission Size "+fmt.Sprint(transmissionSize))
-
-				// Now we check if the Session in continuous
-				sessionContinuous, newSequence, LastInSequence, previousSessionNumber, previousSequenceNumber =
-					CheckSessionContinuity(transmissionState, sessionNumber, sequenceNumber, previousSessionNumber, previousSequenceNumber)
-				// loggingChannel <- CreateLogMessage(zerolog.DebugLevel, "States: sessionContinuous "+fmt.Sprint(sessionContinuous)+
-				// 	" newSequence "+fmt.Sprint(newSequence)+
-				// 	" LastInSequence "+fmt.Sprint(LastInSequence))
-
-				if newSequence && sessionContinuous {
-					// Lets start a new receipt sequence
-					JSONStartIndex := GetJSONStartIndex()
-
-					JSONByteArray = byteArray[TransportLayerHeaderSize_bytes+SessionLayerHeaderSize_bytes+JSONStartIndex : transmissionSize]
-
-				} else if sessionContinuous && !LastInSequence {
-					// Lets keep accumulating data as we have not finished this continuos sequence
-					JSONStartIndex := 0
-					JSONByteArray = append(JSONByteArray,
-						byteArray[TransportLayerHeaderSize_bytes+SessionLayerHeaderSize_bytes+JSONStartIndex:transmissionSize]...)
-
-				} else if sessionContinuous && LastInSequence {
-					// We have finished the sequence so we can pass on
-					JSONStartIndex := 0
-					JSONByteArray = append(JSONByteArray,
-						byteArray[TransportLayerHeaderSize_bytes+SessionLayerHeaderSize_bytes+JSONStartIndex:transmissionSize]...)
-
-					str := string(JSONByteArray)
-					dataChannel <- str
-
-					JSONByteArray = nil
-				} else {
-					// There was some error so lets reset
-					JSONByteArray = nil
-
-					// The reset all states
-					previousSessionNumber = uint32(0)
-					previousSequenceNumber = uint32(0)
-					sessionContinuous = false
-					newSequence = false
-					LastInSequence = false
-
-					loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "Missed bytes, resetting")
-				}
+	defer conn.Close()
 
-				byteArray = byteArray[TransportLayerDataSize:]
+	// Every message about the connection names it
+	connectionName := conn.RemoteAddr().String()
+	logger = logger.With("remote_address", connectionName)
 
-			}
+	// TLS connections are also identified by their client certificate where they have one
+	if tlsConnection, isTLS := conn.(*tls.Conn); isTLS {
+		identity, err := completeTLSHandshake(ctx, tlsConnection)
+		if err != nil {
+			logger.Warn("TLS handshake failed", "error", err)
+			return
+		}
+		if identity != "" {
+			// A node may reconnect before its old connection closes,
+			// so the remote address keeps each connection's metrics apart
+			connectionName = identity + "@" + connectionName
+			logger = logger.With("identity", identity)
+			logger.Info("Client certificate verified")
 		}
-		loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "TCP server still listening on port:"+port)
 	}
 
-}
+	// Metrics are reported per connection until it closes
+	defer forgetConnectionMetrics(connectionName)
 
-func ConvertBytesToSessionStates(byteArray []byte) (byte, uint32, uint32) {
+	// Closing the connection on shutdown unblocks Read
+	stopReading := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stopReading()
 
-	index := 0
+	// Split the stream into frames as soon as each is complete
+	// and rebuild chunks from the frames of each source and session
+	frameDecoder := NewFrameDecoder(maxFrameSize)
+	sessionReassembler := NewSessionReassembler(sessionTimeout, 0)
+	lastStaleCheck := time.Now()
 
-	// Lets first start by extracting the whether this is the finals sequence in session
-	transmissionState := byteArray[index]
-	index += 1
+	// Create a buffer to read incoming data
+	buffer := make([]byte, 512)
 
-	// Then we extract session number
-	sessionNumber := binary.LittleEndian.Uint32(byteArray[index : index+4])
-	index += 4
+	for {
 
-	// And sequence number
-	sequenceNumber := binary.LittleEndian.Uint32(byteArray[index : index+4])
-	index += 4
+		// Read data from the connection into the buffer
+		bytesRead, readError := conn.Read(buffer)
+		if ctx.Err() != nil {
+			logger.Info("Closing connection on shutdown")
+			break
+		}
 
-	// We then ignore chunk type
-	index += 4
-	// And source identifier
-	index += 6
-	// As there is no support for this at the moment
+		// Bytes returned along with an error are processed before the error
+		metricBytesReceived.WithLabelValues(connectionName).Add(float64(bytesRead))
+		frameDecoder.Write(buffer[:bytesRead])
 
-	// And extract how many bytes were in this session transmission
-	return transmissionState, sessionNumber, sequenceNumber
-}
-
-/*
-CheckSessionContinuity Checks if the session data has arrived in order
+		// Then process every frame that is now complete
+		for {
+			frame, frameComplete, err := frameDecoder.Next()
+			if err != nil {
+				metricFramesDiscarded.WithLabelValues(connectionName).Inc()
+				logger.Warn("Discarded bytes to resynchronise", "error", err)
+				continue
+			}
+			if !frameComplete {
+				break
+			}
+			metricFramesReceived.WithLabelValues(connectionName).Inc()
 
-returns whether data arrived in order
-*/
-func CheckSessionContinuity(transmissionState byte, sessionNumber uint32, sequenceNumber uint32, previousSessionNumber uint32, previousSequenceNumber uint32) (bool, bool, bool, uint32, uint32) {
-
-	sessionContinuous := true
-	newSequence := false
-
-	// Now we can check all state variables
-	// Are we the first message in a sequence?
-	StartSequence := (sequenceNumber == 0)
-	// If we are, we then want to know if that sequence is continuous
-	SequenceContinuous := (sequenceNumber == previousSequenceNumber+1) // intra
-	// Now if we know about continuity, is this the last message in the sequence?
-	LastInSequence := transmissionState == 1
-	// Checking if this message belongs to the same sequences
-	SameSession := (sessionNumber == previousSessionNumber) || (sessionNumber == 0) // inter
-
-	// Now we check for continuity
-	if StartSequence {
-		// If it is the first sequence in a session
-		sessionContinuous = true
-		newSequence = true
-	} else if StartSequence || (SameSession && !LastInSequence && SequenceContinuous) {
-		sessionContinuous = true
-		newSequence = false
-	} else if LastInSequence && SameSession && SequenceContinuous {
-		sessionContinuous = true
-		newSequence = false
-	} else {
-		sessionContinuous = false
-		newSequence = true
-	}
+			// The carry on and extract session state information (v1.0.0 of chunk types)
+			sessionHeader := ParseSessionHeader(frame.SessionHeaderBytes)
 
-	// Now update session states
-	previousSequenceNumber = sequenceNumber
-	previousSessionNumber = sessionNumber
+			// Now we add it to its session
+			chunk, chunkComplete, err := sessionReassembler.AddTransmission(sessionHeader, frame.SessionData, time.Now())
+			recordReassemblyResult(chunkComplete, err)
+			if errors.Is(err, ErrSessionNotStarted) {
+				// The rest of a session we already dropped
+				logger.Debug("Missed bytes, dropping", errorFields(err)...)
+			} else if err != nil {
+				logger.Error("Missed bytes, resetting", errorFields(err)...)
+			} else if chunkComplete {
+				select {
+				case dataChannel <- chunk:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
 
-	return sessionContinuous, newSequence, LastInSequence, previousSessionNumber, previousSequenceNumber
-}
+		// Periodically forget sessions that will never complete
+		if time.Since(lastStaleCheck) > time.Second {
+			lastStaleCheck = time.Now()
+			if droppedSessions := sessionReassembler.DropStaleSessions(lastStaleCheck); droppedSessions > 0 {
+				metricSessionsReset.WithLabelValues(sessionResetStale).Add(float64(droppedSessions))
+				logger.Warn("Dropped stale sessions", "dropped_sessions", droppedSessions)
+			}
+		}
 
-func GetJSONStartIndex() int {
-	return 4
+		if errors.Is(readError, io.EOF) {
+			logger.Info("Connection closed")
+			break
+		} else if readError != nil {
+			logger.Error("Error reading", "error", readError)
+			break
+		}
+	}
 }
@@ -0,0 +1,227 @@
+package Routines
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+///
+///			TLS CERTIFICATES
+///
+
+// How often certificate files are checked for changes, at most
+const certificateCheckInterval = 5 * time.Second
+
+// How long a client has to complete the TLS handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+/*
+CertificateReloader serves a certificate and key loaded from files and
+loads them again when either file changes, so certificates can be
+renewed without a restart. If the new files cannot be loaded, such as
+when only one has been replaced so far, the previous certificate is kept
+*/
+type CertificateReloader struct {
+	mu                 sync.Mutex       // Mutex to protect the certificate
+	certificateFile    string           // PEM certificate chain
+	keyFile            string           // PEM private key
+	certificate        *tls.Certificate // Certificate currently served
+	certificateModTime time.Time        // Modification time of the loaded certificate file
+	keyModTime         time.Time        // Modification time of the loaded key file
+	lastCheck          time.Time        // When the files were last checked for changes
+	logger             *Logger
+}
+
+/*
+Create a reloader, failing if the certificate and key cannot be loaded
+*/
+func NewCertificateReloader(certificateFile string, keyFile string, logger *Logger) (*CertificateReloader, error) {
+	reloader := new(CertificateReloader)
+	reloader.certificateFile = certificateFile
+	reloader.keyFile = keyFile
+	reloader.logger = logger
+
+	certificateModTime, keyModTime, err := reloader.fileModTimes()
+	if err != nil {
+		return nil, err
+	}
+	if err := reloader.load(certificateModTime, keyModTime); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+/*
+GetCertificate is used as tls.Config.GetCertificate
+*/
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.lastCheck) >= certificateCheckInterval {
+		r.lastCheck = time.Now()
+		r.reloadIfChanged()
+	}
+	return r.certificate, nil
+}
+
+/*
+Load the files again if either has been modified since it was loaded
+*/
+func (r *CertificateReloader) reloadIfChanged() {
+	certificateModTime, keyModTime, err := r.fileModTimes()
+	if err != nil {
+		r.logger.Warn("Could not check TLS certificate files, keeping the current certificate", "error", err)
+		return
+	}
+	if certificateModTime.Equal(r.certificateModTime) && keyModTime.Equal(r.keyModTime) {
+		return
+	}
+
+	if err := r.load(certificateModTime, keyModTime); err != nil {
+		r.logger.Warn("Could not reload TLS certificate, keeping the current certificate", "certificate_file", r.certificateFile, "error", err)
+		return
+	}
+	r.logger.Info("Reloaded TLS certificate", "certificate_file", r.certificateFile)
+}
+
+func (r *CertificateReloader) load(certificateModTime time.Time, keyModTime time.Time) error {
+	certificate, err := tls.LoadX509KeyPair(r.certificateFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.certificate = &certificate
+	r.certificateModTime = certificateModTime
+	r.keyModTime = keyModTime
+	return nil
+}
+
+func (r *CertificateReloader) fileModTimes() (time.Time, time.Time, error) {
+	certificateInfo, err := os.Stat(r.certificateFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certificateInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+/*
+Handler that redirects every request to the same host and path over
+HTTPS on the given port
+*/
+func newHTTPSRedirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+
+		redirectURL := url.URL{
+			Scheme:   "https",
+			Host:     net.JoinHostPort(host, httpsPort),
+			Path:     r.URL.Path,
+			RawQuery: r.URL.RawQuery,
+		}
+		http.Redirect(w, r, redirectURL.String(), http.StatusPermanentRedirect)
+	})
+}
+
+/*
+Create a server TLS configuration serving the reloader's certificate.
+When a client CA file is given, clients must present a certificate
+signed by one of its certificates
+*/
+func NewServerTLSConfig(certificateReloader *CertificateReloader, clientCAFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		GetCertificate: certificateReloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		clientCAPool, err := LoadCertificatePool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = clientCAPool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+/*
+Create a client TLS configuration. The server is verified against the
+CA file, or the system pool if it is empty, and the client certificate
+is presented if one is given
+*/
+func NewClientTLSConfig(caFile string, certificateFile string, keyFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		caPool, err := LoadCertificatePool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = caPool
+	}
+
+	if (certificateFile == "") != (keyFile == "") {
+		return nil, errors.New("client certificate and key must be given together")
+	} else if certificateFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certificateFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+/*
+Load every PEM certificate in a file into a pool
+*/
+func LoadCertificatePool(certificateFile string) (*x509.CertPool, error) {
+	pemBytes, err := os.ReadFile(certificateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	certificatePool := x509.NewCertPool()
+	if !certificatePool.AppendCertsFromPEM(pemBytes) {
+		return nil, errors.New("no PEM certificates found in " + certificateFile)
+	}
+	return certificatePool, nil
+}
+
+/*
+Complete the handshake of a TLS connection within the handshake timeout
+
+returns the common name of the client certificate, empty if the client
+did not present one
+*/
+func completeTLSHandshake(ctx context.Context, tlsConnection *tls.Conn) (string, error) {
+	handshakeContext, cancelHandshake := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancelHandshake()
+
+	if err := tlsConnection.HandshakeContext(handshakeContext); err != nil {
+		return "", err
+	}
+
+	peerCertificates := tlsConnection.ConnectionState().PeerCertificates
+	if len(peerCertificates) == 0 {
+		return "", nil
+	}
+	return peerCertificates[0].Subject.CommonName, nil
+}
@@ -0,0 +1,130 @@
+package Routines
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// Remote addresses that send nothing for this long have their metrics removed
+const udpConnectionIdleTimeout = time.Minute
+
+/*
+HandleUDPReceivals receives datagrams holding one or more complete frames
+in the same |Transport Header(2)|Session Header(23)|Session Data(x)| format
+as the TCP receiver. Sessions are reassembled across datagrams, tolerating
+datagrams that arrive out of order within the reorder window
+*/
+func HandleUDPReceivals(ctx context.Context, udpRxConfig UDPRxConfig, routineHealth *RoutineHealth, logger *Logger, dataChannel chan<- Chunk) error {
+
+	// Define the UDP port to listen on
+	var port = udpRxConfig.Port.String()
+	var maxFrameSize = int(udpRxConfig.MaxFrameSizeBytes)
+	var sessionTimeout = time.Duration(udpRxConfig.SessionTimeoutSeconds) * time.Second
+
+	packetConnection, err := net.ListenPacket("udp", ":"+port)
+	if err != nil {
+		return err
+	}
+	defer packetConnection.Close()
+	logger.Info("UDP server is listening", "port", port)
+	routineHealth.SetRoutineState(UDPRxRoutineName, RoutineRunning, "Listening on "+packetConnection.LocalAddr().String())
+
+	// Closing the socket on shutdown unblocks ReadFrom
+	stopReading := context.AfterFunc(ctx, func() {
+		packetConnection.Close()
+	})
+	defer stopReading()
+
+	// Every source shares one reassembler as sessions are keyed on source identifier
+	sessionReassembler := NewSessionReassembler(sessionTimeout, int(udpRxConfig.ReorderWindow))
+	lastStaleCheck := time.Now()
+
+	// Remote addresses come and go, so their metrics are removed once idle
+	connectionLastSeen := make(map[string]time.Time)
+
+	// Create a buffer large enough for any datagram
+	buffer := make([]byte, 65535)
+	var readRetryDelay time.Duration
+
+	for {
+
+		bytesRead, remoteAddress, err := packetConnection.ReadFrom(buffer)
+		if ctx.Err() != nil {
+			logger.Info("UDP server stopped listening", "port", port)
+			routineHealth.SetRoutineState(UDPRxRoutineName, RoutineStopped, "")
+			return nil
+		} else if err != nil {
+			// Errors reading the socket tend to persist, so wait before trying again
+			readRetryDelay = nextRetryDelay(readRetryDelay)
+			logger.Error("Error reading", "error", err, "retry_delay", readRetryDelay.String())
+			select {
+			case <-time.After(readRetryDelay):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		readRetryDelay = 0
+
+		// Each remote address is reported as a connection
+		connectionName := "udp:" + remoteAddress.String()
+		connectionLastSeen[connectionName] = time.Now()
+		metricBytesReceived.WithLabelValues(connectionName).Add(float64(bytesRead))
+
+		// Each datagram should hold only whole frames
+		frameDecoder := NewFrameDecoder(maxFrameSize)
+		frameDecoder.Write(buffer[:bytesRead])
+
+		for {
+			frame, frameComplete, err := frameDecoder.Next()
+			if err != nil {
+				metricFramesDiscarded.WithLabelValues(connectionName).Inc()
+				logger.Warn("Discarded bytes of datagram", "remote_address", remoteAddress.String(), "error", err)
+				continue
+			}
+			if !frameComplete {
+				break
+			}
+			metricFramesReceived.WithLabelValues(connectionName).Inc()
+
+			sessionHeader := ParseSessionHeader(frame.SessionHeaderBytes)
+
+			// Now we add it to its session
+			chunk, chunkComplete, err := sessionReassembler.AddTransmission(sessionHeader, frame.SessionData, time.Now())
+			recordReassemblyResult(chunkComplete, err)
+			if errors.Is(err, ErrSessionNotStarted) {
+				// The rest of a session we already dropped
+				logger.Debug("Missed datagrams, dropping", append(errorFields(err), "remote_address", remoteAddress.String())...)
+			} else if err != nil {
+				logger.Error("Missed datagrams, resetting", append(errorFields(err), "remote_address", remoteAddress.String())...)
+			} else if chunkComplete {
+				select {
+				case dataChannel <- chunk:
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		}
+
+		if frameDecoder.Buffered() > 0 {
+			logger.Warn("Datagram ended with an incomplete frame",
+				"remote_address", remoteAddress.String(), "incomplete_bytes", frameDecoder.Buffered())
+		}
+
+		// Periodically forget sessions that will never complete and idle addresses
+		if time.Since(lastStaleCheck) > time.Second {
+			lastStaleCheck = time.Now()
+			if droppedSessions := sessionReassembler.DropStaleSessions(lastStaleCheck); droppedSessions > 0 {
+				metricSessionsReset.WithLabelValues(sessionResetStale).Add(float64(droppedSessions))
+				logger.Warn("Dropped stale UDP sessions", "dropped_sessions", droppedSessions)
+			}
+			for connectionName, lastSeen := range connectionLastSeen {
+				if lastStaleCheck.Sub(lastSeen) > udpConnectionIdleTimeout {
+					delete(connectionLastSeen, connectionName)
+					forgetConnectionMetrics(connectionName)
+				}
+			}
+		}
+	}
+}
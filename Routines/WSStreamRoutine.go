@@ -0,0 +1,241 @@
+package Routines
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+///
+///			MULTIPLEXED STREAM
+///
+
+// Actions a stream client may send
+const (
+	StreamActionSubscribe   = "Subscribe"   // Start or change the subscription to a chunk type
+	StreamActionUnsubscribe = "Unsubscribe" // Stop the subscription to a chunk type
+	StreamActionSetFormat   = "SetFormat"   // Change the format of every following message
+)
+
+/*
+StreamControlMessage is sent by stream clients as a text message to
+change what they receive
+*/
+type StreamControlMessage struct {
+	Action               string   // One of Subscribe, Unsubscribe or SetFormat
+	ChunkType            string   // Chunk type to subscribe to or unsubscribe from
+	Sources              []string // Source identifiers to receive, empty for all
+	MaxMessagesPerSecond float64  // Rate limit of the subscription, 0 for the configured rate
+	Format               string   // Message format for SetFormat, json or binary
+}
+
+/*
+StreamResponse answers every control message as a text message
+{"StreamResponse": {...}}
+*/
+type StreamResponse struct {
+	Action               string   // Action of the control message
+	ChunkType            string   `json:",omitempty"` // Chunk type of the control message
+	Sources              []string `json:",omitempty"` // Source identifiers now subscribed to, empty for all
+	MaxMessagesPerSecond float64  `json:",omitempty"` // Rate limit now applied to the subscription
+	Format               string   `json:",omitempty"` // Message format now used
+	Error                string   `json:",omitempty"` // Why the control message was refused, empty on success
+}
+
+func (r StreamResponse) MarshalMessage() ([]byte, error) {
+	return json.Marshal(map[string]StreamResponse{"StreamResponse": r})
+}
+
+/*
+StreamEnvelope wraps each chunk sent in JSON on a stream so that the
+client can tell which chunk type and source it came from
+*/
+type StreamEnvelope struct {
+	ChunkType        string          // Chunk type name
+	SourceIdentifier string          // Identifier of the producing device
+	SessionNumber    uint32          // Session the chunk was transmitted in
+	Chunk            json.RawMessage // The chunk JSON as received
+}
+
+/*
+Encode a chunk for a stream client. JSON chunks are wrapped in a
+StreamEnvelope and binary chunks are prefixed with the length and name
+of their chunk type
+
+returns the WebSocket message type and payload
+*/
+func encodeStreamMessage(chunk Chunk, format MessageFormat) (int, []byte, error) {
+	if format == MessageFormatBinary {
+		if len(chunk.ChunkType) > math.MaxUint8 {
+			return 0, nil, errors.New("chunk type name is longer than 255 bytes")
+		}
+		binaryMessage, err := chunk.BinaryMessage()
+		if err != nil {
+			return 0, nil, err
+		}
+		message := make([]byte, 0, 1+len(chunk.ChunkType)+len(binaryMessage))
+		message = append(message, byte(len(chunk.ChunkType)))
+		message = append(message, chunk.ChunkType...)
+		message = append(message, binaryMessage...)
+		return websocket.BinaryMessage, message, nil
+	}
+
+	message, err := json.Marshal(StreamEnvelope{
+		ChunkType:        chunk.ChunkType,
+		SourceIdentifier: chunk.SourceIdentifier.String(),
+		SessionNumber:    chunk.SessionNumber,
+		Chunk:            json.RawMessage(chunk.JSONData),
+	})
+	return websocket.TextMessage, message, err
+}
+
+/*
+Upgrade the request to a websocket on which the client chooses the chunk
+types, sources, rate and format it receives with control messages. The
+origin and access token are checked before the upgrade, and each chunk
+type against the token when it is subscribed to
+*/
+func HandleStreamWebSocket(ctx context.Context, c *gin.Context, logger *Logger, chunkTypeHub *ChunkBroadcastHub, authenticator *WebSocketAuthenticator, upgrader *websocket.Upgrader, webSocketTxConfig WebSocketTxConfig) {
+
+	logger = logger.With("remote_address", c.Request.RemoteAddr, "path", "/stream")
+
+	// The format may be chosen up front or changed later
+	messageFormat, err := ParseMessageFormat(c.Query(messageFormatQueryParameter))
+	if err != nil {
+		logger.Info("Websocket error", "error", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	accessToken, err := authenticator.Authenticate(c.Request)
+	if err != nil {
+		statusCode, reason := authorisationFailure(err)
+		metricWebSocketConnectionsRejected.WithLabelValues(reason).Inc()
+		logger.Warn("Websocket connection refused", "error", err, "origin", c.Request.Header.Get("Origin"))
+		if statusCode == http.StatusUnauthorized {
+			c.Header("WWW-Authenticate", "Bearer")
+		}
+		c.JSON(statusCode, gin.H{"error": err.Error()})
+		return
+	}
+	if accessToken.Name != "" {
+		logger = logger.With("client", accessToken.Name)
+	}
+
+	// Upgrade the HTTP request into a websocket
+	client, err := UpgradeWebSocketClient(c, upgrader, webSocketTxConfig, logger)
+	if err != nil {
+		logger.Info("Websocket error", "error", err)
+		return
+	}
+	defer client.Close()
+
+	logger.Warn("Websocket connection connected", "format", messageFormat)
+
+	// Every subscription forwards to this connection, and any of them
+	// falling behind under the Disconnect policy disconnects the client
+	outgoingMessages := make(chan outgoingMessage)
+	subscriptions := make(map[string]*chunkSubscription)
+	defer func() {
+		for _, subscription := range subscriptions {
+			subscription.Stop(chunkTypeHub)
+		}
+	}()
+
+	// Apply a control message, returning the response to send
+	handleControlMessage := func(controlMessage StreamControlMessage) StreamResponse {
+		response := StreamResponse{Action: controlMessage.Action, ChunkType: controlMessage.ChunkType}
+
+		switch controlMessage.Action {
+		case StreamActionSubscribe:
+			if !chunkTypeHub.IsRegistered(controlMessage.ChunkType) {
+				response.Error = "ChunkType - " + controlMessage.ChunkType + " - not registered"
+				return response
+			}
+			if !accessToken.Permits(controlMessage.ChunkType) {
+				response.Error = ErrChunkTypeNotPermitted.Error()
+				return response
+			}
+			if !validRequestedRate(controlMessage.MaxMessagesPerSecond) {
+				response.Error = "MaxMessagesPerSecond must not be negative"
+				return response
+			}
+			sources := make(map[SourceIdentifier]bool)
+			for _, source := range controlMessage.Sources {
+				sourceIdentifier, err := ParseSourceIdentifier(source)
+				if err != nil {
+					response.Error = err.Error()
+					return response
+				}
+				sources[sourceIdentifier] = true
+			}
+
+			// Subscribing again replaces the subscription
+			if subscription, exists := subscriptions[controlMessage.ChunkType]; exists {
+				subscription.Stop(chunkTypeHub)
+				delete(subscriptions, controlMessage.ChunkType)
+			}
+			messageRate := clientMessageRate(webSocketTxConfig, controlMessage.ChunkType, controlMessage.MaxMessagesPerSecond)
+			subscription, success := startChunkSubscription(chunkTypeHub, controlMessage.ChunkType, sources, messageRate,
+				controlMessage.ChunkType, outgoingMessages, client.FellBehind)
+			if !success {
+				response.Error = "ChunkType - " + controlMessage.ChunkType + " - not registered"
+				return response
+			}
+			subscriptions[controlMessage.ChunkType] = subscription
+
+			response.Sources = controlMessage.Sources
+			response.MaxMessagesPerSecond = messageRate
+			logger.Info("Stream subscribed", "chunk_type", controlMessage.ChunkType, "sources", strings.Join(controlMessage.Sources, ","),
+				"max_messages_per_second", messageRate)
+
+		case StreamActionUnsubscribe:
+			subscription, exists := subscriptions[controlMessage.ChunkType]
+			if !exists {
+				response.Error = "not subscribed to ChunkType - " + controlMessage.ChunkType
+				return response
+			}
+			subscription.Stop(chunkTypeHub)
+			delete(subscriptions, controlMessage.ChunkType)
+			logger.Info("Stream unsubscribed", "chunk_type", controlMessage.ChunkType)
+
+		case StreamActionSetFormat:
+			format, err := ParseMessageFormat(controlMessage.Format)
+			if err != nil {
+				response.Error = err.Error()
+				return response
+			}
+			messageFormat = format
+			response.Format = string(format)
+
+		default:
+			response.Error = "unknown action, expected " + StreamActionSubscribe + ", " + StreamActionUnsubscribe + " or " + StreamActionSetFormat
+		}
+		return response
+	}
+
+	// Then start up, answering each control message
+	client.Serve(ctx, outgoingMessages, func(chunk Chunk) (int, []byte, error) {
+		return encodeStreamMessage(chunk, messageFormat)
+	}, func(controlMessageBytes []byte) []byte {
+		var controlMessage StreamControlMessage
+		var response StreamResponse
+		if err := json.Unmarshal(controlMessageBytes, &controlMessage); err != nil {
+			response = StreamResponse{Error: "control message is not valid JSON: " + err.Error()}
+		} else {
+			response = handleControlMessage(controlMessage)
+		}
+		if response.Error != "" {
+			logger.Info("Stream control message refused", "action", response.Action, "chunk_type", response.ChunkType, "error", response.Error)
+		}
+
+		responseMessage, _ := response.MarshalMessage()
+		return responseMessage
+	})
+}
@@ -1,294 +1,374 @@
 package Routines
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
-	"os"
+	"strings"
 	"sync"
-	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
-	"github.com/rs/zerolog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
-
-func HandleWebSocketChunkTransmissions(configJson map[string]interface{}, loggingChannel chan map[zerolog.Level]string, incomingDataChannel <-chan string) {
+func HandleWebSocketChunkTransmissions(ctx context.Context, webSocketTxConfig WebSocketTxConfig, chunkTypeRegistry *ChunkTypeRegistry, routineHealth *RoutineHealth, logger *Logger, incomingDataChannel <-chan Chunk, recordChannel chan<- Chunk) error {
 
 	// Create websocket variables
-	var port string
-	var registeredChunks []string
-
-	// And then try parse the JSON string
-	if WebSocketTxConfig, exists := configJson["WebSocketTxConfig"].(map[string]interface{}); exists {
-		port = WebSocketTxConfig["Port"].(string)
-
-		// Unmarshal the JSON data into the slice
-		// And get registered Chunk Types
-		if data, ok := WebSocketTxConfig["RegisteredChunks"].([]interface{}); ok {
-			for _, item := range data {
-				if chunkTypeString, isString := item.(string); isString {
-					registeredChunks = append(registeredChunks, chunkTypeString)
-				}
-			}
-		} else {
-			loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "No chunks found to register in chunk map")
-		}
+	var port = webSocketTxConfig.Port.String()
+	var registeredChunks = webSocketTxConfig.RegisteredChunks
 
-	} else {
-		loggingChannel <- CreateLogMessage(zerolog.FatalLevel, "WebSocketTxConfig Config not found or not correct")
-		os.Exit(1)
-		return
+	if len(registeredChunks) == 0 {
+		logger.Warn("No chunks found to register in chunk map")
 	}
 
+	// Serve wss:// when a certificate is configured
+	var certificateReloader *CertificateReloader
+	var useTLS = webSocketTxConfig.TLSCertificateFile != ""
+	if useTLS {
+		var err error
+		certificateReloader, err = NewCertificateReloader(webSocketTxConfig.TLSCertificateFile, webSocketTxConfig.TLSKeyFile, logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Everything started here stops when either the application
+	// shuts down or the HTTP server fails
+	routineContext, cancelRoutines := context.WithCancel(ctx)
+	defer cancelRoutines()
+
 	// Now we create a routine that will handle the reception
 	// And retransmission of JSON documents
-	var chunkTypeChannelMap = RegisterChunkTypeMap(loggingChannel, registeredChunks)
-	go RunChunkRoutingRoutine(loggingChannel, incomingDataChannel, chunkTypeChannelMap)
+	slowClientPolicy, _ := ParseSlowClientPolicy(webSocketTxConfig.SlowClientPolicy)
+	var chunkTypeHub = RegisterChunkTypeHub(logger, registeredChunks, int(webSocketTxConfig.ClientQueueSize), slowClientPolicy)
+
+	// Report client counts and buffer depths for as long as the hub exists
+	chunkTypeHubCollector := newHubCollector(chunkTypeHub)
+	if err := prometheus.Register(chunkTypeHubCollector); err != nil {
+		return err
+	}
+	defer prometheus.Unregister(chunkTypeHubCollector)
+
+	routingComplete := make(chan struct{})
+	go func() {
+		defer close(routingComplete)
+		routineHealth.SetRoutineState(ChunkRoutingRoutineName, RoutineRunning, "")
+		RunChunkRoutingRoutine(routineContext, logger, incomingDataChannel, recordChannel, chunkTypeHub, chunkTypeRegistry, routineHealth)
+		routineHealth.SetRoutineState(ChunkRoutingRoutineName, RoutineStopped, "")
+	}()
 
 	// Then we run the HTTP router
-	router := RegisterRouterWebSocketPaths(loggingChannel, chunkTypeChannelMap)
-	loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "Starting http router")
-	router.Run(":" + port)
+	var handlerWaitGroup sync.WaitGroup
+	authenticator := NewWebSocketAuthenticator(webSocketTxConfig)
+	router := RegisterRouterWebSocketPaths(routineContext, logger, chunkTypeHub, authenticator, webSocketTxConfig, routineHealth, &handlerWaitGroup)
+	server := &http.Server{Handler: router}
+	if useTLS {
+		server.TLSConfig, _ = NewServerTLSConfig(certificateReloader, "")
+	}
+
+	// Bind first so we know the router is reachable before reporting it running
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		cancelRoutines()
+		<-routingComplete
+		return err
+	}
+
+	// Plain HTTP requests may be redirected to the TLS port
+	var redirectServer *http.Server
+	var redirectListener net.Listener
+	if useTLS && webSocketTxConfig.HTTPRedirectPort != 0 {
+		redirectListener, err = net.Listen("tcp", ":"+webSocketTxConfig.HTTPRedirectPort.String())
+		if err != nil {
+			listener.Close()
+			cancelRoutines()
+			<-routingComplete
+			return err
+		}
+		redirectServer = &http.Server{Handler: newHTTPSRedirectHandler(port)}
+	}
+
+	logger.Info("Starting http router", "port", port, "tls", useTLS)
+	routineHealth.SetRoutineState(WebSocketTxRoutineName, RoutineRunning, "Listening on "+listener.Addr().String())
+	serverErrorChannel := make(chan error, 2)
+	go func() {
+		if useTLS {
+			serverErrorChannel <- server.ServeTLS(listener, "", "")
+		} else {
+			serverErrorChannel <- server.Serve(listener)
+		}
+	}()
+	if redirectServer != nil {
+		logger.Info("Redirecting http to https", "port", webSocketTxConfig.HTTPRedirectPort.String())
+		go func() {
+			serverErrorChannel <- redirectServer.Serve(redirectListener)
+		}()
+	}
 
+	var serverError error
+	select {
+	case serverError = <-serverErrorChannel:
+	case <-routineContext.Done():
+		logger.Info("Stopping http router")
+	}
+	server.Shutdown(context.Background())
+	if redirectServer != nil {
+		redirectServer.Shutdown(context.Background())
+	}
+
+	// Websocket handlers send close frames once the context is cancelled
+	cancelRoutines()
+	handlerWaitGroup.Wait()
+	<-routingComplete
+
+	if serverError != nil && serverError != http.ErrServerClosed {
+		return serverError
+	}
+	routineHealth.SetRoutineState(WebSocketTxRoutineName, RoutineStopped, "")
+	return nil
 }
 
 /*
-Take the list of registered chunk types and create a channel
-corresponding to each one
+Take the list of registered chunk types and create a broadcast hub
+in which each one may be subscribed to
 */
-func RegisterChunkTypeMap(loggingChannel chan map[zerolog.Level]string, registeredChunkTypes []string) *SafeChannelMap {
-
-	chunkTypeChannelMap := make(map[string](chan string))
+func RegisterChunkTypeHub(logger *Logger, registeredChunkTypes []string, clientQueueSize int, slowClientPolicy SlowClientPolicy) *ChunkBroadcastHub {
 
-	// Iterate through all chunk types and create a corresponding channel
+	// Log all chunk types that clients will be able to subscribe to
 	for _, chunkType := range registeredChunkTypes {
-		loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "Registering - "+chunkType+" - in Websocket routing map")
-		chunkTypeChannelMap[chunkType] = make(chan string, 100)
+		logger.Info("Registering chunk type in Websocket routing hub", "chunk_type", chunkType)
 	}
 
-	safeChannelMap := new(SafeChannelMap)
-	safeChannelMap.chunkTypeRoutingMap = chunkTypeChannelMap
-
-	return safeChannelMap
+	return NewChunkBroadcastHub(registeredChunkTypes, clientQueueSize, slowClientPolicy)
 }
 
-func RunChunkRoutingRoutine(loggingChannel chan map[zerolog.Level]string, incomingDataChannel <-chan string, chunkTypeRoutingMap *SafeChannelMap) {
+/*
+Route each incoming chunk to the hub by the chunk type in its session
+header. Chunk type identifiers that are not yet known are resolved once
+from the JSON root key and remembered. The root key of every later chunk
+is checked against the name of its identifier, whether configured or learnt. Chunks are also passed to the record channel
+when it is not nil
+*/
+func RunChunkRoutingRoutine(ctx context.Context, logger *Logger, incomingDataChannel <-chan Chunk, recordChannel chan<- Chunk, chunkTypeHub *ChunkBroadcastHub, chunkTypeRegistry *ChunkTypeRegistry, routineHealth *RoutineHealth) {
 
 	// Create an empty array (or slice) of strings
 	var unregisteredChunkTypes []string
+	loggedChunkTypeMismatches := make(map[string]bool)
 
 	// start up and handle JSON chunks
 	for {
 
-		// Unmarshal the JSON string into a map
-		JSONDataString := <-incomingDataChannel
-		var JSONData map[string]interface{}
-		if err := json.Unmarshal([]byte(JSONDataString), &JSONData); err != nil {
-			loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "Error unmarshaling JSON in routing routine:"+err.Error())
-			// loggingChannel <- CreateLogMessage(zerolog.DebugLevel, "Received JSON as follows { "+JSONDataString+" }")
-			// return
-		} else {
-			// Then try forward the JSON data onwards
-			// By first getting the root JSON Key (ChunkType)
-			var chunkTypeStringKey string
+		// Wait for the next chunk or for shutdown
+		var chunk Chunk
+		select {
+		case chunk = <-incomingDataChannel:
+		case <-ctx.Done():
+			return
+		}
+		routineHealth.ChunkReceived(chunk.ArrivalTime)
+
+		// Resolve the chunk type from its binary identifier
+		chunkTypeStringKey, chunkTypeKnown, chunkTypeLearnt := chunkTypeRegistry.Lookup(chunk.ChunkTypeIdentifier)
+		if !chunkTypeKnown {
+			// Unmarshal the JSON string into a map
+			var JSONData map[string]interface{}
+			if err := json.Unmarshal([]byte(chunk.JSONData), &JSONData); err != nil {
+				metricJSONUnmarshalFailures.Inc()
+				logger.Error("Error unmarshaling JSON in routing routine", "error", err,
+					"chunk_type_identifier", chunk.ChunkTypeIdentifier, "source", chunk.SourceIdentifier, "session_number", chunk.SessionNumber)
+				continue
+			}
 
+			// By getting the root JSON Key (ChunkType)
 			for key := range JSONData {
 				chunkTypeStringKey = key
 				break // We assume there's only one root key
 			}
 
-			// And checking if it exists and trying to route it
-			sentSuccessfully := chunkTypeRoutingMap.SendSafeChannelMapData(chunkTypeStringKey, JSONDataString)
-			if !sentSuccessfully {
-				// We did not send data so we
-				// now we see if we have logged
-				// that the channel does not exist
-				var chunkTypeAlreadyLogged = false
-				for _, LoggedChunkTypeString := range unregisteredChunkTypes {
-					if LoggedChunkTypeString == chunkTypeStringKey {
-						chunkTypeAlreadyLogged = true
-					}
+			chunkTypeRegistry.Learn(chunk.ChunkTypeIdentifier, chunkTypeStringKey)
+			logger.Info("Learnt ChunkType identifier", "chunk_type_identifier", chunk.ChunkTypeIdentifier, "chunk_type", chunkTypeStringKey)
+		} else if rootKey, err := chunkRootKey(chunk.JSONData); err == nil && rootKey != chunkTypeStringKey {
+			// An identifier may be shared by several chunk types, for example by
+			// producers that leave it zero, or be configured differently to what
+			// a device sends, so each chunk is routed by its root key
+			metricChunkTypeMismatches.WithLabelValues(chunkTypeStringKey, rootKey).Inc()
+			mismatch := chunkTypeStringKey + "/" + rootKey
+			if !loggedChunkTypeMismatches[mismatch] {
+				loggedChunkTypeMismatches[mismatch] = true
+				logger.Warn("ChunkType does not match the one known for its identifier", "chunk_type_identifier", chunk.ChunkTypeIdentifier,
+					"expected_chunk_type", chunkTypeStringKey, "identifier_learnt", chunkTypeLearnt, "chunk_type", rootKey, "source", chunk.SourceIdentifier)
+			}
+			chunkTypeStringKey = rootKey
+		}
+		chunk.ChunkType = chunkTypeStringKey
+		chunk.binaryMessage = new(binaryChunkMessage)
+
+		// Every chunk is recorded, whether or not any client can receive it
+		queueChunkRecord(recordChannel, chunk)
+
+		// And checking if it exists and publishing it to all subscribers
+		sentSuccessfully := chunkTypeHub.Publish(chunk)
+		if !sentSuccessfully {
+			metricUnregisteredChunks.WithLabelValues(chunkTypeStringKey).Inc()
+
+			// We did not send data so we
+			// now we see if we have logged
+			// that the channel does not exist
+			var chunkTypeAlreadyLogged = false
+			for _, LoggedChunkTypeString := range unregisteredChunkTypes {
+				if LoggedChunkTypeString == chunkTypeStringKey {
+					chunkTypeAlreadyLogged = true
 				}
+			}
 
-				// And log if we have not logged already
-				if !chunkTypeAlreadyLogged {
-					unregisteredChunkTypes = append(unregisteredChunkTypes, chunkTypeStringKey)
-					loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "ChunkType - "+chunkTypeStringKey+" - not registered in routing map")
-				}
+			// And log if we have not logged already
+			if !chunkTypeAlreadyLogged {
+				unregisteredChunkTypes = append(unregisteredChunkTypes, chunkTypeStringKey)
+				logger.Warn("ChunkType not registered in routing map", "chunk_type", chunkTypeStringKey)
 			}
 		}
 	}
 }
 
-func RegisterRouterWebSocketPaths(loggingChannel chan map[zerolog.Level]string, chunkTypeChannelMap *SafeChannelMap) *gin.Engine {
-
-	router := gin.Default()
-
-	// Allow all origins to connect
-	// Note that is is not safe
-	upgrader.CheckOrigin = func(r *http.Request) bool {
-		return true
+/*
+The root key of a chunk's JSON, read without decoding the rest of it
+*/
+func chunkRootKey(JSONData string) (string, error) {
+	decoder := json.NewDecoder(strings.NewReader(JSONData))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return "", errors.New("chunk JSON is not an object")
 	}
+	token, err := decoder.Token()
+	if err != nil {
+		return "", err
+	}
+	rootKey, isString := token.(string)
+	if !isString {
+		return "", errors.New("chunk JSON object is empty")
+	}
+	return rootKey, nil
+}
 
-	router.GET("/DataTypes/TimeChunk", func(c *gin.Context) {
-		// Upgrade the HTTP request into a websocket
-		WebSocketConnection, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-		if err != nil {
-			// If it does not work log an error
-			loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "Websocket error: "+err.Error())
-			return
-		}
-		defer WebSocketConnection.Close()
-
-		loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "TimeChunk websocket connection connected")
-
-		currentTime := time.Now()
-		lastTime := currentTime
-
-		// Ten start up
-		var dataString, success = chunkTypeChannelMap.ReceiveSafeChannelMapData("TimeChunk")
-		if success {
-			WebSocketConnection.WriteMessage(websocket.TextMessage, []byte(dataString))
-			for {
-
-				currentTime = time.Now()
-				timeDiff := currentTime.Sub(lastTime)
-
-				var dataString, _ = chunkTypeChannelMap.ReceiveSafeChannelMapData("TimeChunk")
-
-				// Rate limiting
-				if timeDiff > (time.Millisecond * 1) {
-					WebSocketConnection.WriteMessage(websocket.TextMessage, []byte(dataString))
-					lastTime = currentTime
-				}
+func RegisterRouterWebSocketPaths(ctx context.Context, logger *Logger, chunkTypeHub *ChunkBroadcastHub, authenticator *WebSocketAuthenticator, webSocketTxConfig WebSocketTxConfig, routineHealth *RoutineHealth, handlerWaitGroup *sync.WaitGroup) *gin.Engine {
 
-			}
+	// Access tokens given in the query are hidden before requests are logged
+	router := gin.New()
+	router.Use(hideAccessTokenQuery, gin.Logger(), gin.Recovery())
 
-		} else {
-			loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "Websocket error: TimeChunk channel does not exist")
-		}
+	// Only configured origins may connect from a browser, and
+	// compression is offered to clients if it is enabled
+	upgrader := &websocket.Upgrader{
+		ReadBufferSize:    int(webSocketTxConfig.ReadBufferSize),
+		WriteBufferSize:   int(webSocketTxConfig.WriteBufferSize),
+		EnableCompression: bool(webSocketTxConfig.EnableCompression),
+		CheckOrigin:       authenticator.CheckOrigin,
+	}
 
+	// Expose routine health for probes, metrics for scraping and
+	// administration of the running application to admin tokens only
+	RegisterHealthPaths(router, routineHealth)
+	router.GET("/metrics", authenticator.RequireMetricsAccess, gin.WrapH(promhttp.Handler()))
+	if authenticator.MetricsArePublic() {
+		logger.Warn("Serving /metrics without an access token as no Admin token is configured")
+	}
+	adminRoutes := router.Group("/", authenticator.RequireAdmin)
+	RegisterAdminPaths(adminRoutes, logger)
+
+	// Every registered chunk type is served by the same handler
+	router.GET("/DataTypes/:chunkType", func(c *gin.Context) {
+		handlerWaitGroup.Add(1)
+		defer handlerWaitGroup.Done()
+		HandleChunkTypeWebSocket(ctx, c, logger, chunkTypeHub, authenticator, upgrader, webSocketTxConfig)
 	})
 
-	router.GET("/DataTypes/FFTMagnitudeChunk", func(c *gin.Context) {
-		// Upgrade the HTTP request into a websocket
-		WebSocketConnection, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-		if err != nil {
-			// If it does not work log an error
-			loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "Websocket error: "+err.Error())
-			return
-		}
-		defer WebSocketConnection.Close()
-
-		loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "FFTMagnitudeChunk websocket connection connected")
-
-		currentTime := time.Now()
-		lastTime := currentTime
-
-		// Then start up
-		var dataString, success = chunkTypeChannelMap.ReceiveSafeChannelMapData("FFTMagnitudeChunk")
-		if success {
-			WebSocketConnection.WriteMessage(websocket.TextMessage, []byte(dataString))
-			for {
-
-				currentTime = time.Now()
-				timeDiff := currentTime.Sub(lastTime)
-
-				var dataString, _ = chunkTypeChannelMap.ReceiveSafeChannelMapData("FFTMagnitudeChunk")
-
-				// Rate limiting
-				if timeDiff > (time.Millisecond * 1) {
-					WebSocketConnection.WriteMessage(websocket.TextMessage, []byte(dataString))
-					lastTime = currentTime
-				}
-
-			}
-		} else {
-			loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "Websocket error: FFTMagnitudeChunk channel does not exist")
-		}
-
+	// While a single stream carries any chunk types the client subscribes to
+	router.GET("/stream", func(c *gin.Context) {
+		handlerWaitGroup.Add(1)
+		defer handlerWaitGroup.Done()
+		HandleStreamWebSocket(ctx, c, logger, chunkTypeHub, authenticator, upgrader, webSocketTxConfig)
 	})
 
 	return router
 }
 
-///
-///			ROUTINE SAFE MAP FUNCTIONS
-///
-
 /*
-Routine safe map of key value pairs of strings and channels.
-Each string corresponds to channel to send a chunk type to a
-routine that shall handle that chunk
+Upgrade the request to a websocket and stream every chunk of the
+requested chunk type to it. Unregistered chunk types are rejected
+with a 404 and clients that may not subscribe with a 401 or 403
+before the upgrade
 */
-type SafeChannelMap struct {
-	mu                  sync.Mutex               // Mutex to protect access to the map
-	chunkTypeRoutingMap map[string](chan string) // Map of chunk type string and channel key value pairs
-}
+func HandleChunkTypeWebSocket(ctx context.Context, c *gin.Context, logger *Logger, chunkTypeHub *ChunkBroadcastHub, authenticator *WebSocketAuthenticator, upgrader *websocket.Upgrader, webSocketTxConfig WebSocketTxConfig) {
 
-/*
-Data string will be routed in the map given that chunk type key exists
-*/
-func (s *SafeChannelMap) SendSafeChannelMapData(chunkTypeKey string, data string) bool {
-
-	// We first check if the channel exists
-	// And wait to try get it
-	chunkRoutingChannel, channelExists := s.TryGetChannel(chunkTypeKey)
-	if channelExists {
-		// and pass the data if it does
-		chunkRoutingChannel <- data
-		return channelExists
-	} else {
-		// or drop data and return false
-		return channelExists
-	}
-}
+	chunkType := c.Param("chunkType")
+	logger = logger.With("chunk_type", chunkType, "remote_address", c.Request.RemoteAddr)
 
-func (s *SafeChannelMap) ReceiveSafeChannelMapData(chunkTypeKey string) (dataString string, success bool) {
-	// We first check if the channel exists
-	// And wait to try get it
-	chunkRoutingChannel, channelExists := s.TryGetChannel(chunkTypeKey)
-	if channelExists {
-		// and pass the data if it does
-		var data = <-chunkRoutingChannel
-		success = true
-		return data, success
-	} else {
-		// or drop data and return false
-		success = false
-		return "", success
+	// Check the chunk type exists before upgrading
+	if !chunkTypeHub.IsRegistered(chunkType) {
+		logger.Info("Websocket error: chunk type is not registered")
+		c.JSON(http.StatusNotFound, gin.H{"error": "ChunkType - " + chunkType + " - not registered"})
+		return
 	}
 
-}
+	// Clients may ask for chunks in binary rather than JSON
+	messageFormat, err := ParseMessageFormat(c.Query(messageFormatQueryParameter))
+	if err != nil {
+		logger.Info("Websocket error", "error", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	logger = logger.With("format", messageFormat)
 
-/*
-We try and wait to get access to a channel. Once we get it, we can return it because channels
-are routine safe. Concurrently accessing map requires mutex
-*/
-func (s *SafeChannelMap) TryGetChannel(chunkType string) (extractedChannel chan string, exists bool) {
-	for {
-		var lockAcquired chan struct{}
-		lockAcquired = make(chan struct{}, 1)
+	// And may lower the rate they receive chunks at
+	requestedRate, err := parseRequestedRate(c.Query(rateQueryParameter))
+	if err != nil {
+		logger.Info("Websocket error", "error", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	messageRate := clientMessageRate(webSocketTxConfig, chunkType, requestedRate)
+
+	// Then that the client may subscribe to it
+	clientName, err := authenticator.Authorise(c.Request, chunkType)
+	if err != nil {
+		statusCode, reason := authorisationFailure(err)
+		metricWebSocketConnectionsRejected.WithLabelValues(reason).Inc()
+		logger.Warn("Websocket connection refused", "error", err, "origin", c.Request.Header.Get("Origin"), "client", clientName)
+		if statusCode == http.StatusUnauthorized {
+			c.Header("WWW-Authenticate", "Bearer")
+		}
+		c.JSON(statusCode, gin.H{"error": err.Error()})
+		return
+	}
+	if clientName != "" {
+		logger = logger.With("client", clientName)
+	}
 
-		go func() {
-			s.mu.Lock()
-			extractedChannel, exists = s.chunkTypeRoutingMap[chunkType]
-			s.mu.Unlock()
-			defer close(lockAcquired)
-		}()
+	// Upgrade the HTTP request into a websocket
+	client, err := UpgradeWebSocketClient(c, upgrader, webSocketTxConfig, logger)
+	if err != nil {
+		// If it does not work log an error
+		logger.Info("Websocket error", "error", err)
+		return
+	}
+	defer client.Close()
 
-		select {
-		case <-lockAcquired:
-			// Lock was acquired
-			return extractedChannel, exists
-		case <-time.After(1 * time.Millisecond):
-			// Lock was not acquired, sleep and retry
-			time.Sleep(1 * time.Millisecond) // Sleep for 500 milliseconds, you can adjust the duration as needed.
-		}
+	// Each connection gets its own copy of every chunk
+	outgoingMessages := make(chan outgoingMessage)
+	subscription, success := startChunkSubscription(chunkTypeHub, chunkType, nil, messageRate, "", outgoingMessages, client.FellBehind)
+	if !success {
+		logger.Info("Websocket error: chunk type is not registered")
+		return
 	}
+	defer subscription.Stop(chunkTypeHub)
+
+	logger.Warn("Websocket connection connected", "max_messages_per_second", messageRate)
+
+	// Then start up
+	client.Serve(ctx, outgoingMessages, func(chunk Chunk) (int, []byte, error) {
+		return encodeChunkMessage(chunk, messageFormat)
+	}, nil)
 }
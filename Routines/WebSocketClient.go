@@ -0,0 +1,457 @@
+package Routines
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+)
+
+///
+///			WEBSOCKET CLIENT CONNECTIONS
+///
+
+// Largest message accepted from a WebSocket client
+const maxClientMessageBytes = 64 * 1024
+
+// Time allowed to send a close frame to a client
+const closeFrameTimeout = time.Second
+
+/*
+WebSocketClient is an upgraded WebSocket connection. It handles what
+every WebSocket path shares: keepalive, write timeouts, slow clients and
+saying why the client was disconnected
+*/
+type WebSocketClient struct {
+	connection           *websocket.Conn
+	logger               *Logger
+	compressionThreshold int           // Messages shorter than this are sent uncompressed
+	writeTimeout         time.Duration // Time a client has to accept each message
+	keepaliveTimeout     time.Duration // Time a client may send nothing for, 0 for no limit
+	closed               chan struct{} // Closed once the client is closed
+	fellBehind           chan struct{} // Closed once the client fell behind
+	fellBehindOnce       sync.Once
+}
+
+/*
+Upgrade the HTTP request into a websocket configured from the transmitter
+config. The client must be closed once served
+*/
+func UpgradeWebSocketClient(c *gin.Context, upgrader *websocket.Upgrader, webSocketTxConfig WebSocketTxConfig, logger *Logger) (*WebSocketClient, error) {
+	connection, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compression only applies if the client negotiated it
+	if err := connection.SetCompressionLevel(int(webSocketTxConfig.CompressionLevel)); err != nil {
+		logger.Warn("Websocket error", "error", err)
+	}
+
+	client := new(WebSocketClient)
+	client.connection = connection
+	client.logger = logger
+	client.compressionThreshold = int(webSocketTxConfig.CompressionThresholdBytes)
+	client.writeTimeout = time.Duration(webSocketTxConfig.WriteTimeoutSeconds) * time.Second
+	client.keepaliveTimeout = time.Duration(webSocketTxConfig.KeepaliveTimeoutSeconds) * time.Second
+	client.closed = make(chan struct{})
+	client.fellBehind = make(chan struct{})
+	return client, nil
+}
+
+/*
+Close the connection, stopping the routine reading from it
+*/
+func (c *WebSocketClient) Close() {
+	close(c.closed)
+	c.connection.Close()
+}
+
+/*
+FellBehind disconnects a client that could not keep up. It may be called
+from any routine and more than once
+*/
+func (c *WebSocketClient) FellBehind() {
+	c.fellBehindOnce.Do(func() {
+		close(c.fellBehind)
+
+		// The close frame is sent first as it can only be sent while the
+		// connection works, and a TLS connection stops working for good
+		// once a write times out. It cannot be sent while a write is stuck,
+		// in which case the client is cut off straight away
+		closeMessage := websocket.FormatCloseMessage(disconnectSlowClient.CloseCode, disconnectSlowClient.Reason)
+		if err := c.connection.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(closeFrameTimeout)); err != nil {
+			c.connection.UnderlyingConn().SetWriteDeadline(time.Now())
+		}
+	})
+}
+
+/*
+Message queued for a client, holding either a chunk or a rate limit status
+*/
+type outgoingMessage struct {
+	chunk           Chunk
+	rateLimitStatus *RateLimitStatus
+}
+
+/*
+Serve writes to the client until it disconnects, falls behind or ctx is
+cancelled. Chunks from outgoingMessages are written as encodeChunk
+encodes them. Text messages from the client are passed to
+handleClientMessage, if it is not nil, and the reply written back.
+Both functions are called from this routine only
+*/
+func (c *WebSocketClient) Serve(ctx context.Context, outgoingMessages <-chan outgoingMessage, encodeChunk func(Chunk) (int, []byte, error), handleClientMessage func([]byte) []byte) {
+
+	// Read from the client so that we notice it closing or going quiet
+	var clientMessages chan []byte
+	if handleClientMessage != nil {
+		clientMessages = make(chan []byte)
+	}
+	readErrors := make(chan error, 1)
+	go readWebSocketClient(c.connection, c.keepaliveTimeout, clientMessages, c.closed, readErrors)
+
+	// And ping it so that a live client always has something to answer
+	var pingTickerChannel <-chan time.Time
+	if c.keepaliveTimeout > 0 {
+		pingTicker := time.NewTicker(keepalivePingInterval(c.keepaliveTimeout))
+		defer pingTicker.Stop()
+		pingTickerChannel = pingTicker.C
+	}
+
+	for {
+		select {
+		case message := <-outgoingMessages:
+			if !c.writeOutgoingMessage(message, encodeChunk) {
+				return
+			}
+
+		case clientMessage := <-clientMessages:
+			if !c.write(websocket.TextMessage, handleClientMessage(clientMessage)) {
+				return
+			}
+
+		case <-pingTickerChannel:
+			if err := c.connection.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.writeTimeout)); err != nil {
+				c.writeFailed(err)
+				return
+			}
+
+		case <-c.fellBehind:
+			closeWebSocketClient(c.connection, c.logger, disconnectSlowClient)
+			return
+
+		case err := <-readErrors:
+			closeWebSocketClient(c.connection, c.logger, disconnectReadFailed(err))
+			return
+
+		case <-ctx.Done():
+			// Let the client know we are going away
+			closeWebSocketClient(c.connection, c.logger, disconnectShutdown)
+			return
+		}
+	}
+}
+
+/*
+Encode and write a chunk or status, returning false if the client was disconnected
+*/
+func (c *WebSocketClient) writeOutgoingMessage(message outgoingMessage, encodeChunk func(Chunk) (int, []byte, error)) bool {
+	if message.rateLimitStatus != nil {
+		status, _ := message.rateLimitStatus.MarshalMessage()
+		return c.write(websocket.TextMessage, status)
+	}
+
+	messageType, data, err := encodeChunk(message.chunk)
+	if err != nil {
+		metricWebSocketMessagesDropped.WithLabelValues(message.chunk.ChunkType, messageDropEncodingError).Inc()
+		c.logger.Warn("Error encoding chunk", "error", err, "source", message.chunk.SourceIdentifier, "session_number", message.chunk.SessionNumber)
+		return true
+	}
+
+	if !c.write(messageType, data) {
+		return false
+	}
+	metricWebSocketMessagesSent.WithLabelValues(message.chunk.ChunkType).Inc()
+	return true
+}
+
+/*
+Write a message, returning false if the client was disconnected
+*/
+func (c *WebSocketClient) write(messageType int, message []byte) bool {
+	if err := writeWebSocketMessage(c.connection, messageType, message, c.writeTimeout, c.compressionThreshold); err != nil {
+		c.writeFailed(err)
+		return false
+	}
+	return true
+}
+
+/*
+Writes fail when a client stops accepting messages or falls behind
+*/
+func (c *WebSocketClient) writeFailed(err error) {
+	select {
+	case <-c.fellBehind:
+		closeWebSocketClient(c.connection, c.logger, disconnectSlowClient)
+	default:
+		closeWebSocketClient(c.connection, c.logger, disconnectWriteFailed(err))
+	}
+}
+
+/*
+WebSocketDisconnect describes why a client was disconnected. It is
+logged, counted and, where the connection still works, sent to the
+client in the close frame
+*/
+type WebSocketDisconnect struct {
+	MetricReason string // Reason label of the disconnect metric
+	CloseCode    int    // Close frame status code, 0 to send no close frame
+	Reason       string // Reason given in the close frame and log
+	Err          error  // Underlying error, if any
+}
+
+var (
+	disconnectShutdown         = WebSocketDisconnect{MetricReason: "shutdown", CloseCode: websocket.CloseGoingAway, Reason: "Server shutting down"}
+	disconnectSlowClient       = WebSocketDisconnect{MetricReason: "slow_client", CloseCode: websocket.ClosePolicyViolation, Reason: "Client fell behind"}
+	disconnectKeepaliveTimeout = WebSocketDisconnect{MetricReason: "keepalive_timeout", CloseCode: websocket.CloseGoingAway, Reason: "Keepalive timed out"}
+)
+
+/*
+Disconnect after a failed write. The connection can no longer be
+written to so no close frame is sent
+*/
+func disconnectWriteFailed(err error) WebSocketDisconnect {
+	return WebSocketDisconnect{MetricReason: "write_failed", Reason: "Write failed", Err: err}
+}
+
+/*
+Disconnect after reading from the client failed, which is how a client
+closing the connection, or going silent for too long, is noticed
+*/
+func disconnectReadFailed(err error) WebSocketDisconnect {
+	var closeError *websocket.CloseError
+	if errors.As(err, &closeError) {
+		return WebSocketDisconnect{MetricReason: "client_closed", Reason: "Closed by client", Err: err}
+	}
+
+	var netError net.Error
+	if errors.As(err, &netError) && netError.Timeout() {
+		disconnect := disconnectKeepaliveTimeout
+		disconnect.Err = err
+		return disconnect
+	}
+	return WebSocketDisconnect{MetricReason: "read_failed", Reason: "Read failed", Err: err}
+}
+
+/*
+Log and count a disconnect and send its close frame
+*/
+func closeWebSocketClient(connection *websocket.Conn, logger *Logger, disconnect WebSocketDisconnect) {
+	metricWebSocketDisconnects.WithLabelValues(disconnect.MetricReason).Inc()
+
+	level := zerolog.WarnLevel
+	if disconnect.MetricReason == disconnectShutdown.MetricReason || disconnect.MetricReason == "client_closed" {
+		level = zerolog.InfoLevel
+	}
+	if disconnect.Err != nil {
+		logger.Log(level, "Websocket connection closed", "reason", disconnect.Reason, "error", disconnect.Err)
+	} else {
+		logger.Log(level, "Websocket connection closed", "reason", disconnect.Reason)
+	}
+
+	if disconnect.CloseCode != 0 {
+		closeMessage := websocket.FormatCloseMessage(disconnect.CloseCode, disconnect.Reason)
+		connection.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(closeFrameTimeout))
+	}
+}
+
+/*
+Read from a client until the connection fails so that pings, pongs and
+close frames are handled. With a keepalive timeout set, the client must
+send a message or pong within each timeout. Text messages are passed on
+clientMessages if it is not nil, and discarded otherwise. The error
+ending the connection is sent on readErrors
+*/
+func readWebSocketClient(connection *websocket.Conn, keepaliveTimeout time.Duration, clientMessages chan<- []byte, done <-chan struct{}, readErrors chan<- error) {
+	connection.SetReadLimit(maxClientMessageBytes)
+
+	extendReadDeadline := func(string) error {
+		if keepaliveTimeout <= 0 {
+			return nil
+		}
+		return connection.SetReadDeadline(time.Now().Add(keepaliveTimeout))
+	}
+	extendReadDeadline("")
+	connection.SetPongHandler(extendReadDeadline)
+
+	for {
+		messageType, messageReader, err := connection.NextReader()
+		if err != nil {
+			readErrors <- err
+			return
+		}
+		extendReadDeadline("")
+
+		if clientMessages == nil || messageType != websocket.TextMessage {
+			continue
+		}
+		message, err := io.ReadAll(messageReader)
+		if err != nil {
+			readErrors <- err
+			return
+		}
+		select {
+		case clientMessages <- message:
+		case <-done:
+			return
+		}
+	}
+}
+
+/*
+Write a message to a client, failing if it is not accepted within the
+write timeout. Messages shorter than the compression threshold are not
+compressed
+*/
+func writeWebSocketMessage(connection *websocket.Conn, messageType int, message []byte, writeTimeout time.Duration, compressionThreshold int) error {
+	connection.EnableWriteCompression(len(message) >= compressionThreshold)
+	if err := connection.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	return connection.WriteMessage(messageType, message)
+}
+
+/*
+Interval pings are sent at so that a pong is due well within the keepalive timeout
+*/
+func keepalivePingInterval(keepaliveTimeout time.Duration) time.Duration {
+	return keepaliveTimeout * 9 / 10
+}
+
+///
+///			CHUNK SUBSCRIPTIONS
+///
+
+/*
+chunkSubscription forwards the chunks of one chunk type from the hub to
+a client, filtered by source and rate limited
+*/
+type chunkSubscription struct {
+	chunkType       string
+	sources         map[SourceIdentifier]bool // Sources to forward, empty for all
+	messageRate     float64                   // Messages per second at most, 0 for no limit
+	statusChunkType string                    // Chunk type named in rate limit status messages, empty for none
+	subscriber      *ChunkSubscriber
+	stop            chan struct{}  // Closed to stop forwarding
+	stopped         sync.WaitGroup // Done once forwarding has stopped
+}
+
+/*
+Subscribe to a chunk type and forward its chunks to outgoingMessages
+until stopped. A subscriber that falls behind under the Disconnect
+policy calls fellBehind
+
+returns false if the chunk type is not registered
+*/
+func startChunkSubscription(chunkTypeHub *ChunkBroadcastHub, chunkType string, sources map[SourceIdentifier]bool, messageRate float64, statusChunkType string, outgoingMessages chan<- outgoingMessage, fellBehind func()) (*chunkSubscription, bool) {
+	subscriber, success := chunkTypeHub.Subscribe(chunkType)
+	if !success {
+		return nil, false
+	}
+
+	subscription := new(chunkSubscription)
+	subscription.chunkType = chunkType
+	subscription.sources = sources
+	subscription.messageRate = messageRate
+	subscription.statusChunkType = statusChunkType
+	subscription.subscriber = subscriber
+	subscription.stop = make(chan struct{})
+	subscription.stopped.Add(1)
+	go subscription.forward(outgoingMessages, fellBehind)
+	return subscription, true
+}
+
+/*
+Stop forwarding and unsubscribe from the hub
+*/
+func (s *chunkSubscription) Stop(chunkTypeHub *ChunkBroadcastHub) {
+	close(s.stop)
+	s.stopped.Wait()
+	chunkTypeHub.Unsubscribe(s.subscriber)
+}
+
+func (s *chunkSubscription) forward(outgoingMessages chan<- outgoingMessage, fellBehind func()) {
+	defer s.stopped.Done()
+
+	// Clients are told how many messages they missed if they are rate limited
+	rateLimiter := NewLatestWinsRateLimiter(s.messageRate)
+	defer rateLimiter.Stop()
+	var reportedDroppedMessages uint64
+	var statusTickerChannel <-chan time.Time
+	if s.messageRate > 0 {
+		statusTicker := time.NewTicker(rateLimitStatusInterval)
+		defer statusTicker.Stop()
+		statusTickerChannel = statusTicker.C
+	}
+
+	// The client may fall behind while a message waits to be written
+	send := func(message outgoingMessage) bool {
+		select {
+		case outgoingMessages <- message:
+			return true
+		case <-s.subscriber.Overflowed():
+			fellBehind()
+			return false
+		case <-s.stop:
+			return false
+		}
+	}
+
+	for {
+		select {
+		case chunk := <-s.subscriber.Channel:
+			if len(s.sources) > 0 && !s.sources[chunk.SourceIdentifier] {
+				continue
+			}
+
+			// Chunks arriving faster than the rate limit replace the one waiting
+			droppedMessages := rateLimiter.DroppedMessages()
+			chunk, sendNow := rateLimiter.Offer(chunk, time.Now())
+			if rateLimiter.DroppedMessages() > droppedMessages {
+				metricWebSocketMessagesDropped.WithLabelValues(s.chunkType, messageDropRateLimit).Inc()
+			}
+			if sendNow && !send(outgoingMessage{chunk: chunk}) {
+				return
+			}
+
+		case <-rateLimiter.Ready():
+			if chunk, sendNow := rateLimiter.TakePending(time.Now()); sendNow && !send(outgoingMessage{chunk: chunk}) {
+				return
+			}
+
+		case <-statusTickerChannel:
+			if rateLimiter.DroppedMessages() == reportedDroppedMessages {
+				continue
+			}
+			reportedDroppedMessages = rateLimiter.DroppedMessages()
+			status := &RateLimitStatus{ChunkType: s.statusChunkType, MaxMessagesPerSecond: s.messageRate, DroppedMessages: reportedDroppedMessages}
+			if !send(outgoingMessage{rateLimitStatus: status}) {
+				return
+			}
+
+		case <-s.subscriber.Overflowed():
+			fellBehind()
+			return
+
+		case <-s.stop:
+			return
+		}
+	}
+}
@@ -1,59 +1,185 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Sense-Scape/Go_TCP_Websocket_Adapter/v2/Routines"
-	"github.com/rs/zerolog"
 )
 
 func main() {
 
-	// Create a decoder to read JSON data from the file
-	// Open the JSON file for reading
 	routineCompleteChannel := make(chan bool)
-	var routineCount = 0
-	configFile, err := os.Open("Config.json")
 
+	// Read and validate the configuration, reporting every problem at once
+	serverConfig, err := Routines.LoadConfig("Config.json")
 	if err != nil {
-		fmt.Println("Config not found")
+		fmt.Println("Error reading Config.json: " + err.Error())
 		os.Exit(1)
 		return
 	}
-	defer configFile.Close()
 
-	decoder := json.NewDecoder(configFile)
-
-	// Create a variable to store the decoded JSON data
-	var serverConfigStringMap map[string]interface{}
-	// Decode the JSON data into a map
-	if err := decoder.Decode(&serverConfigStringMap); err != nil {
-		fmt.Println("Error reading Config.json")
+	// Either serve sensor nodes, replay a recording in their place or simulate them
+	commandOptions, err := parseCommand(os.Args[1:], serverConfig)
+	if err != nil {
+		fmt.Println("Error reading command line: " + err.Error())
+		os.Exit(2)
 		return
 	}
+	command := commandOptions.Command
+
+	// Every routine stops when we receive SIGINT or SIGTERM
+	signalContext, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	ctx, cancelRoutines := context.WithCancel(signalContext)
+	defer cancelRoutines()
+
+	// Every routine reports its state here for the health endpoints
+	routineHealth := Routines.NewRoutineHealth()
+
+	// Routines queue structured messages without waiting on the logging routine
+	logLevel, _ := Routines.ParseLoggingLevel(serverConfig.LoggingConfig.LoggingLevel)
+	logger := Routines.NewLogger(int(serverConfig.LoggingConfig.MessageBufferSize), logLevel)
 
-	LoggingChannel := make(chan map[zerolog.Level]string)
+	// Routines report a failure on this channel, which also shuts down the rest
+	var routineWaitGroup sync.WaitGroup
+	routineErrorChannel := make(chan error, 5)
 
-	routineCount = routineCount + 1
-	go Routines.HandleLogging(serverConfigStringMap, routineCompleteChannel, LoggingChannel)
+	routineHealth.SetRoutineState(Routines.LoggingRoutineName, Routines.RoutineStarting, "")
+	go Routines.HandleLogging(serverConfig.LoggingConfig, routineHealth, routineCompleteChannel, routineErrorChannel, logger)
 
-	routineCount = routineCount + 1
-	GenericChunkChannel := make(chan string)
-	go Routines.HandleTCPReceivals(serverConfigStringMap, LoggingChannel, GenericChunkChannel)
+	// Chunk type names are shared by every routine that routes chunks
+	chunkTypeRegistry := Routines.NewChunkTypeRegistry(serverConfig.ApplicationConfig.ChunkTypeIdentifiers)
 
-	routineCount = routineCount + 1
-	go Routines.HandleWebSocketChunkTransmissions(serverConfigStringMap, LoggingChannel, GenericChunkChannel)
+	GenericChunkChannel := make(chan Routines.Chunk)
 
-	for {
-		time.Sleep(60 * time.Second)
+	if command == serveCommand {
+		routineWaitGroup.Add(1)
+		routineHealth.SetRoutineState(Routines.TCPRxRoutineName, Routines.RoutineStarting, "")
+		go func() {
+			defer routineWaitGroup.Done()
+			if err := Routines.HandleTCPReceivals(ctx, serverConfig.TCPRxConfig, routineHealth, logger, GenericChunkChannel); err != nil {
+				routineHealth.SetRoutineState(Routines.TCPRxRoutineName, Routines.RoutineFailed, err.Error())
+				routineErrorChannel <- fmt.Errorf("TCP receiver: %w", err)
+			}
+		}()
+	} else if command == replayCommand {
+		// Recorded chunks take the place of sensor nodes, so readiness
+		// only depends on clients being able to connect
+		routineHealth.SetReadinessRoutines(Routines.WebSocketTxRoutineName)
+		routineWaitGroup.Add(1)
+		routineHealth.SetRoutineState(Routines.ReplayRoutineName, Routines.RoutineStarting, "")
+		go func() {
+			defer routineWaitGroup.Done()
+			if err := Routines.HandleChunkReplay(ctx, commandOptions.ReplayOptions, routineHealth, logger, GenericChunkChannel); err != nil {
+				routineHealth.SetRoutineState(Routines.ReplayRoutineName, Routines.RoutineFailed, err.Error())
+				routineErrorChannel <- fmt.Errorf("Replay: %w", err)
+			}
+		}()
+	} else if command == simulateCommand {
+		// Only the simulated nodes run, sending to an adapter elsewhere,
+		// and the application stops once they have sent every chunk.
+		// No router runs, so there are no health paths to report readiness on
+		routineWaitGroup.Add(1)
+		routineHealth.SetRoutineState(Routines.SimulatorRoutineName, Routines.RoutineStarting, "")
+		go func() {
+			defer routineWaitGroup.Done()
+			if err := Routines.RunSimulator(ctx, commandOptions.SimulatorOptions, routineHealth, logger); err != nil {
+				routineHealth.SetRoutineState(Routines.SimulatorRoutineName, Routines.RoutineFailed, err.Error())
+				routineErrorChannel <- fmt.Errorf("Simulator: %w", err)
+				return
+			}
+			cancelRoutines()
+		}()
+	}
 
-		myMap := make(map[zerolog.Level]string)
-		myMap[zerolog.DebugLevel] = "Main keep alive"
+	// UDP shares the chunk channel with TCP
+	if command == serveCommand && serverConfig.UDPRxConfig.Enabled {
+		routineWaitGroup.Add(1)
+		routineHealth.SetRoutineState(Routines.UDPRxRoutineName, Routines.RoutineStarting, "")
+		go func() {
+			defer routineWaitGroup.Done()
+			if err := Routines.HandleUDPReceivals(ctx, serverConfig.UDPRxConfig, routineHealth, logger, GenericChunkChannel); err != nil {
+				routineHealth.SetRoutineState(Routines.UDPRxRoutineName, Routines.RoutineFailed, err.Error())
+				routineErrorChannel <- fmt.Errorf("UDP receiver: %w", err)
+			}
+		}()
+	}
 
-		LoggingChannel <- myMap
+	// The recorder is fed by the routing routine when enabled,
+	// other than when replaying a recording
+	var recordChannel chan Routines.Chunk
+	if command == serveCommand && serverConfig.RecorderConfig.Enabled {
+		recordChannel = make(chan Routines.Chunk, int(serverConfig.RecorderConfig.ChunkBufferSize))
+		routineWaitGroup.Add(1)
+		routineHealth.SetRoutineState(Routines.RecorderRoutineName, Routines.RoutineStarting, "")
+		go func() {
+			defer routineWaitGroup.Done()
+			if err := Routines.HandleChunkRecording(ctx, serverConfig.RecorderConfig, routineHealth, logger, recordChannel); err != nil {
+				routineHealth.SetRoutineState(Routines.RecorderRoutineName, Routines.RoutineFailed, err.Error())
+				routineErrorChannel <- fmt.Errorf("Recorder: %w", err)
+			}
+		}()
+	}
+
+	if command != simulateCommand {
+		routineWaitGroup.Add(1)
+		routineHealth.SetRoutineState(Routines.WebSocketTxRoutineName, Routines.RoutineStarting, "")
+		go func() {
+			defer routineWaitGroup.Done()
+			if err := Routines.HandleWebSocketChunkTransmissions(ctx, serverConfig.WebSocketTxConfig, chunkTypeRegistry, routineHealth, logger, GenericChunkChannel, recordChannel); err != nil {
+				routineHealth.SetRoutineState(Routines.WebSocketTxRoutineName, Routines.RoutineFailed, err.Error())
+				routineErrorChannel <- fmt.Errorf("WebSocket transmitter: %w", err)
+			}
+		}()
+	}
 
+	// Wait until we are asked to stop or a routine fails.
+	// Liveness is reported by the /healthz endpoint
+	exitCode := 0
+	select {
+	case <-ctx.Done():
+		if signalContext.Err() != nil {
+			logger.Info("Shutdown signal received")
+		} else {
+			logger.Info("Finished, shutting down")
+		}
+	case err := <-routineErrorChannel:
+		logger.Error("Shutting down after error", "error", err)
+		exitCode = 1
 	}
+
+	// Then give every routine the shutdown timeout to stop
+	cancelRoutines()
+	shutdownTimeout := time.Duration(serverConfig.ApplicationConfig.ShutdownTimeoutSeconds) * time.Second
+	shutdownDeadline := time.After(shutdownTimeout)
+
+	routinesStopped := make(chan struct{})
+	go func() {
+		routineWaitGroup.Wait()
+		close(routinesStopped)
+	}()
+
+	select {
+	case <-routinesStopped:
+	case <-shutdownDeadline:
+		fmt.Println("Routines did not stop within " + shutdownTimeout.String() + ", exiting anyway")
+		os.Exit(1)
+	}
+
+	// Once nothing else can log, drain the logger and flush the log file
+	logger.Close()
+	select {
+	case <-routineCompleteChannel:
+	case <-shutdownDeadline:
+		fmt.Println("Logging did not stop within " + shutdownTimeout.String() + ", exiting anyway")
+		os.Exit(1)
+	}
+
+	os.Exit(exitCode)
 }